@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/capsule8/capsule8/pkg/sensor"
+)
+
+// routingAttributeFields maps the routing attribute names chunk2-5 asks for
+// to the JSON field name(s) that might carry them on TelemetryEventData.
+// TelemetryEventData's definition isn't part of this package (it lives in
+// the core sensor.go, alongside Sensor and Subscription), so rather than
+// hard-code Go struct field names that may not match, each candidate is
+// looked up by its JSON encoding; whichever one the real struct defines is
+// picked up, and any this build of the sensor doesn't define are simply
+// left off the returned attributes.
+var routingAttributeFields = map[string][]string{
+	"pid":          {"Pid", "PID", "pid"},
+	"container_id": {"ContainerId", "ContainerID", "container_id"},
+	"process_name": {"ProcessName", "Comm", "process_name"},
+	"sensor_id":    {"SensorId", "SensorID", "sensor_id"},
+}
+
+// routingAttributes extracts Pub/Sub routing attributes from event: its
+// concrete type name plus whichever of the common correlation fields above
+// its TelemetryEventData happens to define. Subscribers can use these with
+// Pub/Sub filter expressions to pre-filter server-side instead of consuming
+// the full firehose.
+func routingAttributes(event sensor.TelemetryEvent) map[string]string {
+	attrs := map[string]string{"event_type": eventTypeName(event)}
+
+	raw, err := json.Marshal(event.CommonTelemetryEventData())
+	if err != nil {
+		return attrs
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return attrs
+	}
+
+	for attr, names := range routingAttributeFields {
+		for _, name := range names {
+			raw, ok := fields[name]
+			if !ok {
+				continue
+			}
+			if v, ok := decodeAttributeValue(raw); ok {
+				attrs[attr] = v
+				break
+			}
+		}
+	}
+	return attrs
+}
+
+// decodeAttributeValue renders a JSON scalar as a string suitable for a
+// Pub/Sub attribute value, skipping zero values so an unset field doesn't
+// show up as an empty or "0" attribute.
+func decodeAttributeValue(raw json.RawMessage) (string, bool) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, s != ""
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n.String(), n.String() != "0"
+	}
+	return "", false
+}
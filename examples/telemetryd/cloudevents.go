@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/capsule8/capsule8/pkg/sensor"
+	uuid "github.com/satori/go.uuid"
+)
+
+// cloudEventSource is the CloudEvents "source" attribute for every event
+// telemetryd publishes. It identifies the producer, not the individual
+// sensor instance.
+const cloudEventSource = "/capsule8/sensor"
+
+// cloudEventIDNamespace namespaces the UUIDv5 used to derive a CloudEvents
+// id from an event's own content, so ids don't collide with UUIDs minted by
+// unrelated namespaces.
+var cloudEventIDNamespace = uuid.NewV5(uuid.NamespaceURL, "capsule8.io/telemetryd")
+
+// cloudEventEnvelope is the CloudEvents v1.0 structured-mode JSON envelope.
+// See https://github.com/cloudevents/spec/blob/v1.0/json-format.md.
+type cloudEventEnvelope struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Subject         string          `json:"subject,omitempty"`
+	Type            string          `json:"type"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// eventTypeName is an event's concrete Go type name with the package
+// qualifier stripped, e.g. sensor.NetworkConnectAttemptTelemetryEvent
+// becomes "NetworkConnectAttemptTelemetryEvent".
+func eventTypeName(event sensor.TelemetryEvent) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", event), "sensor.")
+}
+
+// cloudEventType derives a CloudEvents reverse-DNS type string from an
+// event's concrete Go type, e.g. sensor.NetworkConnectAttemptTelemetryEvent
+// becomes "com.capsule8.telemetry.NetworkConnectAttemptTelemetryEvent".
+func cloudEventType(event sensor.TelemetryEvent) string {
+	return "com.capsule8.telemetry." + eventTypeName(event)
+}
+
+// cloudEventID derives a stable id for event from its own JSON-encoded
+// content plus its type, so republishing the same event (e.g. after a sink
+// retry) yields the same id instead of a fresh one each call — the
+// CloudEvents id exists for consumer-side dedup/idempotency, which a
+// randomly generated id defeats.
+func cloudEventID(event sensor.TelemetryEvent, data json.RawMessage) string {
+	return uuid.NewV5(cloudEventIDNamespace, cloudEventType(event)+":"+string(data)).String()
+}
+
+// cloudEventSubject returns the CloudEvents "subject" attribute for event:
+// the most specific of its container id, pid, or process name, in that
+// order, so consumers can correlate events about the same entity without
+// parsing the full payload. Returns "" if event carries none of these.
+func cloudEventSubject(event sensor.TelemetryEvent) string {
+	attrs := routingAttributes(event)
+	for _, attr := range []string{"container_id", "pid", "process_name"} {
+		if v, ok := attrs[attr]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func newCloudEventEnvelope(event sensor.TelemetryEvent, data json.RawMessage) cloudEventEnvelope {
+	return cloudEventEnvelope{
+		SpecVersion:     "1.0",
+		ID:              cloudEventID(event, data),
+		Source:          cloudEventSource,
+		Subject:         cloudEventSubject(event),
+		Type:            cloudEventType(event),
+		Time:            time.Now().UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+}
+
+// structuredCloudEvent wraps data (the JSON-encoded event) in a CloudEvents
+// v1.0 structured-mode envelope, to be published as the sink message body.
+// Unlike binary mode, it adds no ce-* attributes to the message.
+func structuredCloudEvent(event sensor.TelemetryEvent, data []byte) ([]byte, error) {
+	envelope := newCloudEventEnvelope(event, data)
+	payload, err := json.Marshal(&envelope)
+	if err != nil {
+		return nil, fmt.Errorf("marshal cloudevents envelope: %v", err)
+	}
+	return payload, nil
+}
+
+// binaryCloudEventAttributes returns the ce-* attributes CloudEvents v1.0
+// binary mode carries alongside data (the JSON-encoded event) as the sink
+// message body, in place of the HTTP binding's ce-* headers.
+func binaryCloudEventAttributes(event sensor.TelemetryEvent, data json.RawMessage) map[string]string {
+	envelope := newCloudEventEnvelope(event, data)
+	attrs := map[string]string{
+		"ce-specversion":     envelope.SpecVersion,
+		"ce-id":              envelope.ID,
+		"ce-source":          envelope.Source,
+		"ce-type":            envelope.Type,
+		"ce-time":            envelope.Time,
+		"ce-datacontenttype": envelope.DataContentType,
+	}
+	if envelope.Subject != "" {
+		attrs["ce-subject"] = envelope.Subject
+	}
+	return attrs
+}
@@ -5,18 +5,18 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
+	"time"
 
-	"cloud.google.com/go/pubsub"
 	telemetryAPI "github.com/capsule8/capsule8/api/v0"
+	"github.com/capsule8/capsule8/examples/telemetryd/sink"
 	"github.com/capsule8/capsule8/pkg/sensor"
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/jsonpb"
-	"google.golang.org/api/option"
-	"google.golang.org/grpc"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -25,23 +25,26 @@ var (
 )
 
 var flags struct {
-	pubsubPath       string
-	credentialsFile  string
-	subscriptionFile string
-	dumpConfig       bool
-	useEmulator      bool
+	sinkURL           string
+	subscriptionFile  string
+	dumpConfig        bool
+	format            string
+	spoolDir          string
+	deadLetterSinkURL string
+	metricsAddr       string
+	batchMaxMessages  int
+	batchMaxBytes     int
+	batchMaxLatency   time.Duration
 }
 
 func main() {
 	var err error
 	ctx, cancel := context.WithCancel(context.Background())
 
-	flag.StringVar(&flags.pubsubPath, "pubsub", "",
-		"Cloud Pubsub path (e.g. projects/PROJECT_ID/topics/TOPIC_ID)")
-
-	// Config file can contain pubsub topic, creds, and subscription spec
-	flag.StringVar(&flags.credentialsFile, "credentials", "",
-		"path to Google Cloud credentials file")
+	flag.StringVar(&flags.sinkURL, "sink", "",
+		"sink URL to publish events to, e.g. gcp-pubsub:projects/P/topics/T, "+
+			"kafka://broker:9092/topic, nats://host:4222/subject, "+
+			"mqtt://host:1883/topic, file:///path/to/file.ndjson, or stdout://")
 
 	flag.StringVar(&flags.subscriptionFile, "subscription", "",
 		"path to JSON subscription file")
@@ -49,13 +52,44 @@ func main() {
 	flag.BoolVar(&flags.dumpConfig, "p", false,
 		"print subscription as JSON")
 
-	flag.BoolVar(&flags.useEmulator, "emulator", false,
-		"use local Pub/Sub emulator")
+	flag.StringVar(&flags.format, "format", "raw",
+		"message format to publish: raw, cloudevents-structured, or cloudevents-binary")
+
+	flag.StringVar(&flags.spoolDir, "spool-dir", "",
+		"directory to spool events in for at-least-once delivery; delivery is best-effort if empty")
+
+	flag.StringVar(&flags.deadLetterSinkURL, "dead-letter-sink", "",
+		"sink URL for events that exceed the retry limit (only used with -spool-dir)")
+
+	flag.StringVar(&flags.metricsAddr, "metrics-addr", "",
+		"address to serve Prometheus metrics on (e.g. :9102); disabled if empty")
+
+	flag.IntVar(&flags.batchMaxMessages, "batch-max-messages", 1,
+		"events packed into a single sink message; 1 disables batching")
+
+	flag.IntVar(&flags.batchMaxBytes, "batch-max-bytes", 1<<20,
+		"packed bytes budget per batch message, clamped to stay under the 10MB Pub/Sub message limit")
+
+	flag.DurationVar(&flags.batchMaxLatency, "batch-max-latency", time.Second,
+		"how long a partial batch waits for more events before being flushed anyway")
 
 	// Configure glog
 	flag.Set("logtostderr", "true")
 	flag.Parse()
 
+	switch flags.format {
+	case "raw", "cloudevents-structured", "cloudevents-binary":
+	default:
+		glog.Fatalf("unknown -format %q", flags.format)
+	}
+
+	if flags.format == "cloudevents-binary" && flags.batchMaxMessages > 1 {
+		glog.Fatalf("-format=cloudevents-binary is incompatible with -batch-max-messages=%d: "+
+			"ce-id and ce-time are unique per event, so every event would differ from the batch "+
+			"in progress and NewBatchingPublisher would flush after each one, collapsing every "+
+			"batch to size 1", flags.batchMaxMessages)
+	}
+
 	if len(flags.subscriptionFile) > 0 {
 		f, err := os.Open(flags.subscriptionFile)
 		if err != nil {
@@ -81,17 +115,54 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Try to connect to PubSub
-	if len(flags.pubsubPath) == 0 {
+	if len(flags.sinkURL) == 0 {
 		flag.Usage()
 		os.Exit(0)
 	}
 
-	topic, err := connectToPubsubTopic(ctx, flags.pubsubPath)
+	pub, err := sink.Open(ctx, flags.sinkURL)
 	if err != nil {
 		glog.Fatal(err)
 	}
 
+	if flags.batchMaxMessages > 1 {
+		pub, err = sink.NewBatchingPublisher(pub, sink.BatchOptions{
+			MaxMessages: flags.batchMaxMessages,
+			MaxBytes:    flags.batchMaxBytes,
+			MaxLatency:  flags.batchMaxLatency,
+		})
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	if flags.spoolDir != "" {
+		var deadLetter sink.Publisher
+		if flags.deadLetterSinkURL != "" {
+			deadLetter, err = sink.Open(ctx, flags.deadLetterSinkURL)
+			if err != nil {
+				glog.Fatal(err)
+			}
+		}
+
+		pub, err = sink.NewReliablePublisher(pub, sink.ReliableOptions{
+			SpoolDir:   flags.spoolDir,
+			DeadLetter: deadLetter,
+		})
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	if flags.metricsAddr != "" {
+		go func() {
+			http.Handle("/metrics", promhttp.Handler())
+			if err := http.ListenAndServe(flags.metricsAddr, nil); err != nil {
+				glog.Warningf("metrics server: %v", err)
+			}
+		}()
+	}
+
 	//
 	// Create sensor based on given or default subscription
 	//
@@ -106,40 +177,19 @@ func main() {
 		glog.Fatal(err)
 	}
 
-	sub := s.NewSubscription()
-	sub.ProcessTelemetryServiceSubscription(&subscription)
-
-	errors, err := sub.Run(ctx, func(event sensor.TelemetryEvent) {
-		nEvents++
-
-		//
-		// The output formatting could use some work
-		//
-		var e struct {
-			EventType      string
-			TelemetryEvent *sensor.TelemetryEvent
-		}
-
-		e.EventType = fmt.Sprintf("%T", event)
-		e.TelemetryEvent = &event
-
-		// Need an event type name
-		jsonString, err := json.Marshal(&e)
-		if err != nil {
-			glog.Warning(err)
-			return
-		}
-
-		m := pubsub.Message{Data: jsonString}
-		topic.Publish(ctx, &m)
-	})
-
-	if err != nil {
+	runner := newSubscriptionRunner(s, pub)
+	if err := runner.start(ctx, subscription); err != nil {
 		glog.Fatal(err)
 	}
 
-	if len(errors) > 0 {
-		glog.Fatal(errors)
+	if flags.subscriptionFile != "" {
+		path := flags.subscriptionFile
+		err := watchSubscriptionFile(ctx, path, func() {
+			runner.reload(ctx, path)
+		})
+		if err != nil {
+			glog.Warningf("subscription hot-reload disabled: %v", err)
+		}
 	}
 
 	// Trap Control-C
@@ -148,46 +198,58 @@ func main() {
 
 	<-c
 	glog.Info("Received interrupt signal, exiting...")
+	runner.stop()
 	cancel()
 	s.Stop()
+	pub.Close()
 
 	glog.Infof("Received %d events", nEvents)
 	os.Exit(1)
 }
 
-func connectToPubsubTopic(ctx context.Context, path string) (*pubsub.Topic, error) {
-	parts := strings.Split(path, "/")
-	if parts[0] != "projects" || parts[2] != "topics" {
-		return nil, fmt.Errorf("could not parse pubsub path %s", path)
-	}
-
-	project := parts[1]
-	topic := parts[3]
+// publishEvent formats event per -format and publishes it to pub. It is
+// shared by every subscription the runner starts across reloads.
+func publishEvent(ctx context.Context, pub sink.Publisher, event sensor.TelemetryEvent) {
+	nEvents++
 
-	var options []option.ClientOption
-	if flags.useEmulator {
-		options = append(options, option.WithoutAuthentication())
-		options = append(options, option.WithGRPCDialOption(grpc.WithInsecure()))
-	} else if len(flags.credentialsFile) > 0 {
-		options = append(options, option.WithCredentialsFile(flags.credentialsFile))
+	//
+	// The output formatting could use some work
+	//
+	var e struct {
+		EventType      string
+		TelemetryEvent *sensor.TelemetryEvent
 	}
 
-	c, err := pubsub.NewClient(ctx, project, options...)
-	if err != nil {
-		return nil, err
-	}
+	e.EventType = fmt.Sprintf("%T", event)
+	e.TelemetryEvent = &event
 
-	t := c.Topic(topic)
-	ok, err := t.Exists(ctx)
+	// Need an event type name
+	jsonString, err := json.Marshal(&e)
 	if err != nil {
-		return nil, err
+		glog.Warning(err)
+		return
 	}
 
-	if !ok {
-		return nil, nil
+	var (
+		data       = jsonString
+		attributes = routingAttributes(event)
+	)
+	switch flags.format {
+	case "cloudevents-structured":
+		data, err = structuredCloudEvent(event, jsonString)
+		if err != nil {
+			glog.Warning(err)
+			return
+		}
+	case "cloudevents-binary":
+		for k, v := range binaryCloudEventAttributes(event, jsonString) {
+			attributes[k] = v
+		}
 	}
 
-	return t, nil
+	if err := pub.Publish(ctx, "", attributes, data); err != nil {
+		glog.Warning(err)
+	}
 }
 
 func createSubscription() telemetryAPI.Subscription {
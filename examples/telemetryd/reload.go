@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	telemetryAPI "github.com/capsule8/capsule8/api/v0"
+	"github.com/capsule8/capsule8/examples/telemetryd/sink"
+	"github.com/capsule8/capsule8/pkg/sensor"
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/jsonpb"
+)
+
+// subscriptionRunner owns the currently-running sensor.Subscription and lets
+// it be swapped out for a new one without tearing down the sensor itself.
+// Only one subscription runs at a time; reload atomically stops the old one
+// and starts the new one in its place.
+type subscriptionRunner struct {
+	s   *sensor.Sensor
+	pub sink.Publisher
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSubscriptionRunner(s *sensor.Sensor, pub sink.Publisher) *subscriptionRunner {
+	return &subscriptionRunner{s: s, pub: pub}
+}
+
+// start replaces the currently-running subscription, if any, with one
+// matching spec. The new subscription is started and validated before the
+// old one is torn down, so a bad spec leaves the old subscription running
+// instead of leaving telemetry collection dark; only once the new one is
+// confirmed running does the old one get canceled.
+func (r *subscriptionRunner) start(parent context.Context, spec telemetryAPI.Subscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sub := r.s.NewSubscription()
+	sub.ProcessTelemetryServiceSubscription(&spec)
+
+	ctx, cancel := context.WithCancel(parent)
+	errs, err := sub.Run(ctx, func(event sensor.TelemetryEvent) {
+		publishEvent(parent, r.pub, event)
+	})
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	if r.cancel != nil {
+		r.cancel()
+		<-r.done
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if errs, ok := <-errs; ok && len(errs) > 0 {
+			glog.Warningf("subscription run ended with errors: %v", errs)
+		}
+	}()
+
+	r.cancel = cancel
+	r.done = done
+	return nil
+}
+
+// stop cancels the currently-running subscription, if any, and waits for
+// its Run goroutine to finish.
+func (r *subscriptionRunner) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+	r.cancel = nil
+	r.done = nil
+}
+
+// reload loads the subscription at path and swaps it in. Unlike start,
+// reload never kills the process: a malformed or unreadable subscription
+// file is logged and the currently-running subscription keeps running.
+func (r *subscriptionRunner) reload(ctx context.Context, path string) {
+	spec, err := loadSubscriptionFile(path)
+	if err != nil {
+		glog.Warningf("subscription reload: %v, keeping current subscription", err)
+		return
+	}
+
+	if err := r.start(ctx, spec); err != nil {
+		glog.Warningf("subscription reload: %v, keeping current subscription", err)
+		return
+	}
+
+	glog.Infof("subscription reloaded from %s", path)
+}
+
+// loadSubscriptionFile parses a telemetryAPI.Subscription from the JSON
+// file at path.
+func loadSubscriptionFile(path string) (telemetryAPI.Subscription, error) {
+	var spec telemetryAPI.Subscription
+
+	f, err := os.Open(path)
+	if err != nil {
+		return spec, fmt.Errorf("couldn't open subscription JSON file: %v", err)
+	}
+	defer f.Close()
+
+	if err := jsonpb.Unmarshal(f, &spec); err != nil {
+		return spec, fmt.Errorf("couldn't parse subscription JSON: %v", err)
+	}
+	return spec, nil
+}
+
+// watchSubscriptionFile calls reload whenever the subscription file at path
+// changes, either because it was written to (fsnotify) or because the
+// process received SIGHUP. fsnotify watches the containing directory rather
+// than the file itself, since editors and config-management tools commonly
+// replace a file with create+rename rather than writing it in place, which
+// a single-file watch can miss.
+func watchSubscriptionFile(ctx context.Context, path string, reload func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("create file watcher: %v", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return fmt.Errorf("watch %s: %v", dir, err)
+	}
+
+	clean := filepath.Clean(path)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != clean {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				reload()
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				glog.Warningf("subscription file watcher: %v", err)
+
+			case <-hup:
+				reload()
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
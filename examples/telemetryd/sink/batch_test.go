@@ -0,0 +1,148 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// fakePublisher records every Publish call it receives.
+type fakePublisher struct {
+	mu    sync.Mutex
+	calls []struct {
+		attrs map[string]string
+		data  []byte
+	}
+}
+
+func (f *fakePublisher) Publish(ctx context.Context, key string, attributes map[string]string, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, struct {
+		attrs map[string]string
+		data  []byte
+	}{attrs: attributes, data: data})
+	return nil
+}
+
+func (f *fakePublisher) Close() error { return nil }
+
+func TestBatchingPublisherFlushThresholds(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      BatchOptions
+		publishes []struct {
+			attrs map[string]string
+			data  []byte
+		}
+		wantCalls int
+	}{
+		{
+			name: "flushes at MaxMessages",
+			opts: BatchOptions{MaxMessages: 2, MaxBytes: 1 << 20},
+			publishes: []struct {
+				attrs map[string]string
+				data  []byte
+			}{
+				{attrs: map[string]string{"event_type": "A"}, data: []byte("one")},
+				{attrs: map[string]string{"event_type": "A"}, data: []byte("two")},
+				{attrs: map[string]string{"event_type": "A"}, data: []byte("three")},
+			},
+			wantCalls: 1,
+		},
+		{
+			name: "flushes when adding an event would overflow MaxBytes",
+			opts: BatchOptions{MaxMessages: 100, MaxBytes: 9},
+			publishes: []struct {
+				attrs map[string]string
+				data  []byte
+			}{
+				// framedSize = len(data)+1 (NDJSON newline); "abcd"->5, "efgh"->5
+				{attrs: map[string]string{"event_type": "A"}, data: []byte("abcd")},
+				{attrs: map[string]string{"event_type": "A"}, data: []byte("efgh")},
+			},
+			wantCalls: 1,
+		},
+		{
+			name: "flushes when attributes differ instead of dropping them",
+			opts: BatchOptions{MaxMessages: 100, MaxBytes: 1 << 20},
+			publishes: []struct {
+				attrs map[string]string
+				data  []byte
+			}{
+				{attrs: map[string]string{"event_type": "A", "pid": "1"}, data: []byte("one")},
+				{attrs: map[string]string{"event_type": "B", "pid": "2"}, data: []byte("two")},
+			},
+			// The second event's differing attributes flush the first
+			// event's batch immediately rather than merging into it;
+			// the second event itself is still pending, unflushed.
+			wantCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := &fakePublisher{}
+			p, err := NewBatchingPublisher(inner, tt.opts)
+			if err != nil {
+				t.Fatalf("NewBatchingPublisher: %v", err)
+			}
+
+			for _, pub := range tt.publishes {
+				if err := p.Publish(context.Background(), "", pub.attrs, pub.data); err != nil {
+					t.Fatalf("Publish: %v", err)
+				}
+			}
+
+			inner.mu.Lock()
+			got := len(inner.calls)
+			inner.mu.Unlock()
+			if got != tt.wantCalls {
+				t.Fatalf("got %d flushed batches, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestBatchingPublisherPreservesAttributesAcrossDifferingBatches(t *testing.T) {
+	inner := &fakePublisher{}
+	p, err := NewBatchingPublisher(inner, BatchOptions{MaxMessages: 1, MaxBytes: 1 << 20})
+	if err != nil {
+		t.Fatalf("NewBatchingPublisher: %v", err)
+	}
+
+	a := map[string]string{"event_type": "A", "pid": "1"}
+	b := map[string]string{"event_type": "B", "pid": "2"}
+	if err := p.Publish(context.Background(), "", a, []byte("one")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if err := p.Publish(context.Background(), "", b, []byte("two")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	inner.mu.Lock()
+	defer inner.mu.Unlock()
+	if len(inner.calls) != 2 {
+		t.Fatalf("got %d flushed batches, want 2", len(inner.calls))
+	}
+	if !attributesEqual(inner.calls[0].attrs, a) {
+		t.Fatalf("first batch attrs = %v, want %v", inner.calls[0].attrs, a)
+	}
+	if !attributesEqual(inner.calls[1].attrs, b) {
+		t.Fatalf("second batch attrs = %v, want %v", inner.calls[1].attrs, b)
+	}
+}
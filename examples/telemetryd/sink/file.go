@@ -0,0 +1,62 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+)
+
+func init() {
+	Register("file", openFile)
+}
+
+// filePublisher appends newline-delimited event data to a local file. The
+// sink URL is file:///absolute/path/to/file.ndjson.
+type filePublisher struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openFile(ctx context.Context, u *url.URL) (Publisher, error) {
+	path := u.Path
+	if path == "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return nil, fmt.Errorf("file sink URL must include a path, got %q", u.String())
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %v", path, err)
+	}
+
+	return &filePublisher{f: f}, nil
+}
+
+func (p *filePublisher) Publish(ctx context.Context, key string, attributes map[string]string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := fmt.Fprintf(p.f, "%s\n", data)
+	return err
+}
+
+func (p *filePublisher) Close() error {
+	return p.f.Close()
+}
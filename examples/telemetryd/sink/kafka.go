@@ -0,0 +1,74 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+func init() {
+	Register("kafka", openKafka)
+}
+
+// kafkaPublisher publishes to a Kafka topic via a synchronous producer. The
+// sink URL is kafka://broker1:9092,broker2:9092/topic-name.
+type kafkaPublisher struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func openKafka(ctx context.Context, u *url.URL) (Publisher, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("kafka sink URL must include at least one broker, got %q", u.String())
+	}
+	topic := strings.TrimPrefix(u.Path, "/")
+	if topic == "" {
+		return nil, fmt.Errorf("kafka sink URL must include a topic path, got %q", u.String())
+	}
+
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(strings.Split(u.Host, ","), config)
+	if err != nil {
+		return nil, fmt.Errorf("connect to kafka: %v", err)
+	}
+
+	return &kafkaPublisher{producer: producer, topic: topic}, nil
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, key string, attributes map[string]string, data []byte) error {
+	msg := &sarama.ProducerMessage{
+		Topic: p.topic,
+		Value: sarama.ByteEncoder(data),
+	}
+	if key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+	for k, v := range attributes {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+
+	_, _, err := p.producer.SendMessage(msg)
+	return err
+}
+
+func (p *kafkaPublisher) Close() error {
+	return p.producer.Close()
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func init() {
+	Register("mqtt", openMQTT)
+}
+
+// mqttPublisher publishes to an MQTT topic at QoS 1. The sink URL is
+// mqtt://host:1883/topic/path.
+type mqttPublisher struct {
+	client mqtt.Client
+	topic  string
+}
+
+func openMQTT(ctx context.Context, u *url.URL) (Publisher, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("mqtt sink URL must include a host, got %q", u.String())
+	}
+	topic := strings.TrimPrefix(u.Path, "/")
+	if topic == "" {
+		return nil, fmt.Errorf("mqtt sink URL must include a topic path, got %q", u.String())
+	}
+
+	opts := mqtt.NewClientOptions().AddBroker("tcp://" + u.Host)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("connect to mqtt broker: %v", token.Error())
+	}
+
+	return &mqttPublisher{client: client, topic: topic}, nil
+}
+
+func (p *mqttPublisher) Publish(ctx context.Context, key string, attributes map[string]string, data []byte) error {
+	token := p.client.Publish(p.topic, 1, false, data)
+	token.Wait()
+	return token.Error()
+}
+
+func (p *mqttPublisher) Close() error {
+	p.client.Disconnect(250)
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nats-io/go-nats"
+)
+
+func init() {
+	Register("nats", openNATS)
+}
+
+// natsPublisher publishes to a NATS subject. The sink URL is
+// nats://host:4222/subject.name. NATS carries no message attributes, so
+// the attributes argument to Publish is ignored; use cloudevents-structured
+// event formatting if the envelope fields need to travel with the message.
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func openNATS(ctx context.Context, u *url.URL) (Publisher, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("nats sink URL must include a host, got %q", u.String())
+	}
+	subject := strings.TrimPrefix(u.Path, "/")
+	if subject == "" {
+		return nil, fmt.Errorf("nats sink URL must include a subject path, got %q", u.String())
+	}
+
+	conn, err := nats.Connect("nats://" + u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("connect to nats: %v", err)
+	}
+
+	return &natsPublisher{conn: conn, subject: subject}, nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, key string, attributes map[string]string, data []byte) error {
+	return p.conn.Publish(p.subject, data)
+}
+
+func (p *natsPublisher) Close() error {
+	p.conn.Close()
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+)
+
+func init() {
+	Register("gcp-pubsub", openPubSub)
+}
+
+// pubsubPublisher publishes to a Google Cloud Pub/Sub topic. The sink URL
+// accepts both the opaque form gcp-pubsub:projects/PROJECT_ID/topics/TOPIC_ID
+// and the double-slash form gcp-pubsub://projects/PROJECT_ID/topics/TOPIC_ID,
+// with credentials and emulator use configured via query parameters, e.g.
+// gcp-pubsub:projects/P/topics/T?credentials=/path/to/creds.json.
+type pubsubPublisher struct {
+	topic *pubsub.Topic
+}
+
+// parsePubSubPath extracts the project and topic IDs from a gcp-pubsub sink
+// URL, accepting both the opaque form (gcp-pubsub:projects/P/topics/T) and
+// the double-slash form (gcp-pubsub://projects/P/topics/T). u.Opaque holds
+// the path for the former; the latter instead splits "projects" into u.Host
+// and "/P/topics/T" into u.Path, so it has to be reassembled.
+func parsePubSubPath(u *url.URL) (project, topicID string, err error) {
+	path := u.Opaque
+	if path == "" {
+		path = strings.TrimPrefix(u.Host+u.Path, "/")
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "topics" {
+		return "", "", fmt.Errorf(
+			"gcp-pubsub sink must look like gcp-pubsub:projects/PROJECT_ID/topics/TOPIC_ID, got %q", u.String())
+	}
+	return parts[1], parts[3], nil
+}
+
+func openPubSub(ctx context.Context, u *url.URL) (Publisher, error) {
+	project, topicID, err := parsePubSubPath(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var options []option.ClientOption
+	q := u.Query()
+	if q.Get("emulator") == "true" {
+		options = append(options, option.WithoutAuthentication())
+	}
+	if creds := q.Get("credentials"); creds != "" {
+		options = append(options, option.WithCredentialsFile(creds))
+	}
+
+	c, err := pubsub.NewClient(ctx, project, options...)
+	if err != nil {
+		return nil, fmt.Errorf("connect to pubsub: %v", err)
+	}
+
+	return &pubsubPublisher{topic: c.Topic(topicID)}, nil
+}
+
+func (p *pubsubPublisher) Publish(ctx context.Context, key string, attributes map[string]string, data []byte) error {
+	m := &pubsub.Message{Data: data, Attributes: attributes}
+	if key != "" {
+		m.OrderingKey = key
+	}
+	result := p.topic.Publish(ctx, m)
+	_, err := result.Get(ctx)
+	return err
+}
+
+func (p *pubsubPublisher) Close() error {
+	p.topic.Stop()
+	return nil
+}
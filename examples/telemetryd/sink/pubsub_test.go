@@ -0,0 +1,87 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParsePubSubPath(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		wantProject string
+		wantTopic   string
+		wantErr     bool
+	}{
+		{
+			name:        "opaque form",
+			raw:         "gcp-pubsub:projects/P/topics/T",
+			wantProject: "P",
+			wantTopic:   "T",
+		},
+		{
+			name:        "double-slash form",
+			raw:         "gcp-pubsub://projects/P/topics/T",
+			wantProject: "P",
+			wantTopic:   "T",
+		},
+		{
+			name:        "double-slash form with query parameters",
+			raw:         "gcp-pubsub://projects/P/topics/T?emulator=true",
+			wantProject: "P",
+			wantTopic:   "T",
+		},
+		{
+			name:    "missing topics segment",
+			raw:     "gcp-pubsub://projects/P/T",
+			wantErr: true,
+		},
+		{
+			name:    "wrong leading segment",
+			raw:     "gcp-pubsub://subscriptions/P/topics/T",
+			wantErr: true,
+		},
+		{
+			name:    "too few segments",
+			raw:     "gcp-pubsub:projects/P",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.raw)
+			if err != nil {
+				t.Fatalf("url.Parse(%q): %v", tt.raw, err)
+			}
+
+			project, topic, err := parsePubSubPath(u)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsePubSubPath(%q) = %q, %q, nil, want error", tt.raw, project, topic)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePubSubPath(%q): %v", tt.raw, err)
+			}
+			if project != tt.wantProject || topic != tt.wantTopic {
+				t.Fatalf("parsePubSubPath(%q) = %q, %q, want %q, %q", tt.raw, project, topic, tt.wantProject, tt.wantTopic)
+			}
+		})
+	}
+}
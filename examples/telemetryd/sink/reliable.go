@@ -0,0 +1,392 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricEventsEnqueued = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "telemetryd",
+		Subsystem: "sink",
+		Name:      "events_enqueued_total",
+		Help:      "Events the reliable sink wrapper has durably spooled for delivery.",
+	})
+	metricEventsDelivered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "telemetryd",
+		Subsystem: "sink",
+		Name:      "events_delivered_total",
+		Help:      "Events the reliable sink wrapper has successfully delivered to its inner sink.",
+	})
+	metricEventsRetried = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "telemetryd",
+		Subsystem: "sink",
+		Name:      "events_retried_total",
+		Help:      "Delivery attempts the reliable sink wrapper has retried after a failure.",
+	})
+	metricEventsDeadLettered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "telemetryd",
+		Subsystem: "sink",
+		Name:      "events_dead_lettered_total",
+		Help:      "Events the reliable sink wrapper gave up on and handed to the dead-letter sink.",
+	})
+	metricEventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "telemetryd",
+		Subsystem: "sink",
+		Name:      "events_dropped_total",
+		Help:      "Events the reliable sink wrapper gave up on with no dead-letter sink configured.",
+	})
+	metricQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "telemetryd",
+		Subsystem: "sink",
+		Name:      "queue_depth",
+		Help:      "Number of events currently spooled awaiting delivery.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricEventsEnqueued,
+		metricEventsDelivered,
+		metricEventsRetried,
+		metricEventsDeadLettered,
+		metricEventsDropped,
+		metricQueueDepth,
+	)
+}
+
+// ReliableOptions configures NewReliablePublisher.
+type ReliableOptions struct {
+	// SpoolDir is the directory Publish durably writes events to before
+	// returning, and that the background workers drain from. Required.
+	SpoolDir string
+
+	// Workers is the number of goroutines draining the spool
+	// concurrently. Defaults to 4.
+	Workers int
+
+	// MaxRetries is how many times delivery of a single event is retried
+	// after its first failed attempt before it is handed to DeadLetter
+	// (or dropped). Defaults to 8.
+	MaxRetries int
+
+	// InitialBackoff and MaxBackoff bound the exponential backoff
+	// between retries of one event. Default to 500ms and 30s.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// DeadLetter receives events that exceed MaxRetries. If nil, such
+	// events are logged and dropped.
+	DeadLetter Publisher
+}
+
+// NewReliablePublisher wraps inner in at-least-once delivery semantics:
+// Publish durably spools the event to opts.SpoolDir and returns, and a pool
+// of background workers retries delivery to inner with exponential backoff
+// until it succeeds or opts.MaxRetries is exceeded, at which point the
+// event is handed to opts.DeadLetter. Spooled events left over from a
+// previous run (e.g. after a crash) are picked up and retried again here.
+func NewReliablePublisher(inner Publisher, opts ReliableOptions) (Publisher, error) {
+	if opts.SpoolDir == "" {
+		return nil, fmt.Errorf("reliable sink requires a spool directory")
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.MaxRetries <= 0 {
+		opts.MaxRetries = 8
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+
+	if err := os.MkdirAll(opts.SpoolDir, 0700); err != nil {
+		return nil, fmt.Errorf("create spool dir %s: %v", opts.SpoolDir, err)
+	}
+
+	p := &reliablePublisher{
+		inner:    inner,
+		opts:     opts,
+		workCh:   make(chan struct{}, opts.Workers),
+		closing:  make(chan struct{}),
+		inFlight: make(map[string]struct{}),
+	}
+
+	entries, err := ioutil.ReadDir(opts.SpoolDir)
+	if err != nil {
+		return nil, fmt.Errorf("scan spool dir %s: %v", opts.SpoolDir, err)
+	}
+	for _, entry := range entries {
+		seq, ok := seqFromSpoolFilename(entry.Name())
+		if !ok {
+			continue
+		}
+		metricQueueDepth.Inc()
+		if seq > p.seq {
+			p.seq = seq
+		}
+	}
+
+	for i := 0; i < opts.Workers; i++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+
+	return p, nil
+}
+
+// spooledMessage is the on-disk, JSON-encoded form of a Publish call.
+type spooledMessage struct {
+	Key        string            `json:"key,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Data       []byte            `json:"data"`
+	Attempts   int               `json:"attempts"`
+}
+
+type reliablePublisher struct {
+	inner Publisher
+	opts  ReliableOptions
+
+	mu       sync.Mutex
+	seq      uint64
+	inFlight map[string]struct{}
+
+	workCh  chan struct{}
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Publish implements Publisher. It returns once the event is durably
+// spooled, not once it is delivered; delivery happens asynchronously.
+func (p *reliablePublisher) Publish(ctx context.Context, key string, attributes map[string]string, data []byte) error {
+	msg := spooledMessage{Key: key, Attributes: attributes, Data: data}
+
+	p.mu.Lock()
+	p.seq++
+	seq := p.seq
+	p.mu.Unlock()
+
+	payload, err := json.Marshal(&msg)
+	if err != nil {
+		return fmt.Errorf("marshal spooled event: %v", err)
+	}
+
+	path := p.spoolPath(seq)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, payload, 0600); err != nil {
+		return fmt.Errorf("spool event: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("spool event: %v", err)
+	}
+	metricQueueDepth.Inc()
+	metricEventsEnqueued.Inc()
+
+	select {
+	case p.workCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close stops the worker pool once in-flight retries finish their current
+// attempt, and closes inner. Any events still in the spool directory are
+// left on disk to be picked up the next time NewReliablePublisher runs
+// against the same SpoolDir.
+func (p *reliablePublisher) Close() error {
+	close(p.closing)
+	p.wg.Wait()
+	return p.inner.Close()
+}
+
+func (p *reliablePublisher) spoolPath(seq uint64) string {
+	return filepath.Join(p.opts.SpoolDir, fmt.Sprintf("%020d.json", seq))
+}
+
+func (p *reliablePublisher) worker() {
+	defer p.wg.Done()
+	for {
+		if !p.drainOldest() {
+			select {
+			case <-p.workCh:
+			case <-time.After(time.Second):
+			case <-p.closing:
+				return
+			}
+		}
+		select {
+		case <-p.closing:
+			return
+		default:
+		}
+	}
+}
+
+// drainOldest delivers the oldest spooled event, if there is one, retrying
+// with exponential backoff until it succeeds, is dead-lettered, or Close is
+// called. It reports whether it found an event to process.
+func (p *reliablePublisher) drainOldest() bool {
+	path, msg, ok := p.oldestSpooled()
+	if !ok {
+		return false
+	}
+	defer p.release(path)
+
+	backoff := p.opts.InitialBackoff
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := p.inner.Publish(ctx, msg.Key, msg.Attributes, msg.Data)
+		cancel()
+
+		if err == nil {
+			os.Remove(path)
+			metricQueueDepth.Dec()
+			metricEventsDelivered.Inc()
+			return true
+		}
+
+		msg.Attempts++
+		if msg.Attempts > p.opts.MaxRetries {
+			p.deadLetter(path, msg)
+			return true
+		}
+
+		glog.Warningf("sink: delivery attempt %d failed, retrying: %v", msg.Attempts, err)
+		metricEventsRetried.Inc()
+
+		select {
+		case <-time.After(backoff):
+		case <-p.closing:
+			return true
+		}
+		backoff *= 2
+		if backoff > p.opts.MaxBackoff {
+			backoff = p.opts.MaxBackoff
+		}
+	}
+}
+
+func (p *reliablePublisher) deadLetter(path string, msg spooledMessage) {
+	defer func() {
+		os.Remove(path)
+		metricQueueDepth.Dec()
+	}()
+
+	if p.opts.DeadLetter == nil {
+		glog.Warningf("sink: dropping event after %d failed attempts, no dead-letter sink configured", msg.Attempts)
+		metricEventsDropped.Inc()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := p.opts.DeadLetter.Publish(ctx, msg.Key, msg.Attributes, msg.Data); err != nil {
+		glog.Warningf("sink: dead-letter publish failed, dropping event: %v", err)
+		metricEventsDropped.Inc()
+		return
+	}
+	metricEventsDeadLettered.Inc()
+}
+
+// oldestSpooled claims and returns the earliest-sequenced spooled event not
+// already claimed by another worker. Workers run concurrently, so picking
+// "the oldest file on disk" without tracking which files are already being
+// processed would let two workers redeliver (and double-release) the same
+// event; the caller must eventually pass the returned path to release.
+func (p *reliablePublisher) oldestSpooled() (string, spooledMessage, bool) {
+	entries, err := ioutil.ReadDir(p.opts.SpoolDir)
+	if err != nil {
+		glog.Warningf("sink: scan spool dir: %v", err)
+		return "", spooledMessage{}, false
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if _, ok := seqFromSpoolFilename(entry.Name()); ok {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	p.mu.Lock()
+	var claimed string
+	for _, name := range names {
+		if _, ok := p.inFlight[name]; ok {
+			continue
+		}
+		p.inFlight[name] = struct{}{}
+		claimed = name
+		break
+	}
+	p.mu.Unlock()
+	if claimed == "" {
+		return "", spooledMessage{}, false
+	}
+
+	path := filepath.Join(p.opts.SpoolDir, claimed)
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		glog.Warningf("sink: read spooled event %s: %v", path, err)
+		p.release(path)
+		return "", spooledMessage{}, false
+	}
+
+	var msg spooledMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		glog.Warningf("sink: corrupt spooled event %s, discarding: %v", path, err)
+		os.Remove(path)
+		metricQueueDepth.Dec()
+		p.release(path)
+		return "", spooledMessage{}, false
+	}
+
+	return path, msg, true
+}
+
+// release drops path's claim, making it eligible for another worker to pick
+// up again (it will only still be on disk if delivery didn't complete).
+func (p *reliablePublisher) release(path string) {
+	p.mu.Lock()
+	delete(p.inFlight, filepath.Base(path))
+	p.mu.Unlock()
+}
+
+func seqFromSpoolFilename(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, ".json") {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
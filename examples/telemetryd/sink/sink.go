@@ -0,0 +1,74 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sink provides a pluggable publish destination for telemetryd,
+// selected at runtime by the scheme of a -sink=scheme://... URL. The same
+// event stream can be routed to Google Cloud Pub/Sub, Kafka, NATS, MQTT, a
+// local file, or stdout without changing telemetryd's publish loop.
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+// Publisher is a destination telemetryd can publish serialized telemetry
+// events to.
+type Publisher interface {
+	// Publish delivers data (and, for backends that carry them,
+	// attributes) to the sink. key is an optional ordering/partition
+	// key; backends that don't support ordering ignore it.
+	Publish(ctx context.Context, key string, attributes map[string]string, data []byte) error
+
+	// Close releases any resources held by the sink (open files, network
+	// clients, etc.).
+	Close() error
+}
+
+// Opener constructs a Publisher from a parsed -sink URL.
+type Opener func(ctx context.Context, u *url.URL) (Publisher, error)
+
+var (
+	openersMu sync.Mutex
+	openers   = map[string]Opener{}
+)
+
+// Register adds an Opener for scheme. Backend implementations call this
+// from an init function, so importing a backend's package for its side
+// effect is enough to make its scheme available to Open.
+func Register(scheme string, opener Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+	openers[scheme] = opener
+}
+
+// Open parses rawURL and constructs the Publisher registered for its
+// scheme.
+func Open(ctx context.Context, rawURL string) (Publisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse sink URL %q: %v", rawURL, err)
+	}
+
+	openersMu.Lock()
+	opener, ok := openers[u.Scheme]
+	openersMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no sink registered for scheme %q", u.Scheme)
+	}
+
+	return opener(ctx, u)
+}
@@ -0,0 +1,41 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+func init() {
+	Register("stdout", openStdout)
+}
+
+// stdoutPublisher writes newline-delimited event data to stdout. The sink
+// URL is just stdout://, with no host or path.
+type stdoutPublisher struct{}
+
+func openStdout(ctx context.Context, u *url.URL) (Publisher, error) {
+	return stdoutPublisher{}, nil
+}
+
+func (stdoutPublisher) Publish(ctx context.Context, key string, attributes map[string]string, data []byte) error {
+	_, err := fmt.Fprintf(os.Stdout, "%s\n", data)
+	return err
+}
+
+func (stdoutPublisher) Close() error { return nil }
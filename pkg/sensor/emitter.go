@@ -0,0 +1,97 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensor
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+)
+
+// Emitter is an additional sink a subscription's events can be fanned out
+// to alongside the in-process handler passed to Subscription.Run. See
+// WithEmitters.
+type Emitter interface {
+	// EmitEvent delivers event to the sink. Implementations should not
+	// block indefinitely; a slow or unavailable sink should apply its
+	// own timeout/retry policy rather than stalling the caller for
+	// every other emitter and the in-process handler.
+	EmitEvent(ctx context.Context, event TelemetryEvent) error
+
+	// Close releases any resources held by the emitter (open files,
+	// network clients, etc.). Callers are responsible for calling Close
+	// once they are done with the subscription that used it.
+	Close() error
+}
+
+// WithEmitters wraps handler so that, in addition to being invoked
+// directly, every event is also delivered to each of emitters, in the
+// order given. Pass the result to Subscription.Run in handler's place:
+//
+//	errs, err := sub.Run(ctx, sensor.WithEmitters(ctx, handler, pubsubEmitter, fileEmitter))
+//
+// This is the supported way to fan a subscription's events out to
+// additional sinks (e.g. Pub/Sub, a rotating log file): DispatchEvent's
+// internals aren't extensible from outside this package, but the
+// caller-supplied handler passed to Run is, so emitters are composed there
+// instead of through a separate per-Subscription registry.
+func WithEmitters(ctx context.Context, handler func(TelemetryEvent), emitters ...Emitter) func(TelemetryEvent) {
+	if len(emitters) == 0 {
+		return handler
+	}
+	return func(event TelemetryEvent) {
+		handler(event)
+		for _, e := range emitters {
+			if err := e.EmitEvent(ctx, event); err != nil {
+				glog.V(1).Infof("emitter %T: %v", e, err)
+			}
+		}
+	}
+}
+
+// ChannelEmitter is an Emitter that writes events to a Go channel, exposing
+// the in-memory-callback behavior Subscription.Run already provides as an
+// Emitter so it can be composed with other emitters through WithEmitters.
+type ChannelEmitter struct {
+	C chan<- TelemetryEvent
+}
+
+// NewChannelEmitter creates a ChannelEmitter that writes to c.
+func NewChannelEmitter(c chan<- TelemetryEvent) *ChannelEmitter {
+	return &ChannelEmitter{C: c}
+}
+
+// EmitEvent implements Emitter. It does not block if c is full; the event
+// is dropped instead.
+func (e *ChannelEmitter) EmitEvent(ctx context.Context, event TelemetryEvent) error {
+	select {
+	case e.C <- event:
+		return nil
+	default:
+		return errEmitterBackpressure
+	}
+}
+
+// Close implements Emitter. It does not close the underlying channel, since
+// ChannelEmitter does not own it.
+func (e *ChannelEmitter) Close() error {
+	return nil
+}
+
+var errEmitterBackpressure = emitterError("channel emitter buffer full, event dropped")
+
+type emitterError string
+
+func (e emitterError) Error() string { return string(e) }
@@ -0,0 +1,133 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensor
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileEmitter is an Emitter that appends newline-delimited JSON events to a
+// file. Before a write that would take the current file past maxBytes, the
+// file is rotated: it is gzip-compressed to a timestamped copy and a fresh,
+// uncompressed file is started in its place.
+type FileEmitter struct {
+	path     string
+	maxBytes int64
+
+	mu      sync.Mutex
+	f       *os.File
+	written int64
+}
+
+// NewFileEmitter creates a FileEmitter appending to path, rotating before a
+// write would take the current file past maxBytes. A maxBytes of 0 disables
+// rotation.
+func NewFileEmitter(path string, maxBytes int64) (*FileEmitter, error) {
+	e := &FileEmitter{path: path, maxBytes: maxBytes}
+	if err := e.openCurrent(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *FileEmitter) openCurrent() error {
+	f, err := os.OpenFile(e.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open %s: %v", e.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat %s: %v", e.path, err)
+	}
+	e.f = f
+	e.written = info.Size()
+	return nil
+}
+
+// EmitEvent implements Emitter.
+func (e *FileEmitter) EmitEvent(ctx context.Context, event TelemetryEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %v", err)
+	}
+	line = append(line, '\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.maxBytes > 0 && e.written+int64(len(line)) > e.maxBytes {
+		if err := e.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	n, err := e.f.Write(line)
+	e.written += int64(n)
+	return err
+}
+
+// rotateLocked closes the current file, gzip-compresses it alongside a
+// timestamp, and opens a fresh one at e.path. The caller must hold e.mu.
+func (e *FileEmitter) rotateLocked() error {
+	if err := e.f.Close(); err != nil {
+		return fmt.Errorf("close %s: %v", e.path, err)
+	}
+
+	rotated := fmt.Sprintf("%s.%s.gz", e.path, time.Now().UTC().Format("20060102T150405Z"))
+	if err := gzipFile(e.path, rotated); err != nil {
+		return fmt.Errorf("compress %s: %v", e.path, err)
+	}
+	if err := os.Remove(e.path); err != nil {
+		return fmt.Errorf("remove %s: %v", e.path, err)
+	}
+
+	return e.openCurrent()
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		gz.Close()
+		return err
+	}
+	return gz.Close()
+}
+
+// Close implements Emitter.
+func (e *FileEmitter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.f.Close()
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+
+	"github.com/golang/glog"
+)
+
+// PubSubEmitter is an Emitter that publishes serialized network events to a
+// Google Cloud Pub/Sub topic, batched and ordered by (pid, fd) so that
+// events belonging to the same socket are never reordered relative to each
+// other by Pub/Sub's batching.
+type PubSubEmitter struct {
+	topic *pubsub.Topic
+}
+
+// NewPubSubEmitter creates a PubSubEmitter that publishes to topic. Callers
+// are expected to configure topic.PublishSettings (batching, etc.) before
+// passing it in.
+func NewPubSubEmitter(topic *pubsub.Topic) *PubSubEmitter {
+	topic.EnableMessageOrdering = true
+	return &PubSubEmitter{topic: topic}
+}
+
+// pubSubPayload is the wire schema for events published by PubSubEmitter.
+type pubSubPayload struct {
+	EventType string          `json:"event_type"`
+	Event     json.RawMessage `json:"event"`
+}
+
+// EmitEvent implements Emitter. Per the Emitter contract, it does not block
+// the caller on the network round trip Publish kicks off: it hands msg to
+// the topic's own batching/retry machinery and returns immediately, letting
+// the publish result resolve in the background. A failed publish is only
+// logged, not returned to the caller, the same way WithEmitters already
+// only logs a failing emitter rather than stalling the others on it.
+func (e *PubSubEmitter) EmitEvent(ctx context.Context, event TelemetryEvent) error {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %v", err)
+	}
+
+	msg := &pubsub.Message{
+		Data: mustMarshalPubSubPayload(event, encoded),
+	}
+	if key := pubSubOrderingKey(event); key != "" {
+		msg.OrderingKey = key
+	}
+
+	result := e.topic.Publish(ctx, msg)
+	go func() {
+		if _, err := result.Get(ctx); err != nil {
+			glog.V(1).Infof("pubsub publish: %v", err)
+		}
+	}()
+	return nil
+}
+
+func mustMarshalPubSubPayload(event TelemetryEvent, encoded json.RawMessage) []byte {
+	payload := pubSubPayload{
+		EventType: fmt.Sprintf("%T", event),
+		Event:     encoded,
+	}
+	// Marshal of a struct with a json.RawMessage field cannot fail.
+	data, _ := json.Marshal(payload)
+	return data
+}
+
+// pubSubOrderingKey derives the (pid, fd) ordering key for network attempt
+// events, so that e.g. a connect attempt and its result are never delivered
+// out of order relative to each other. fd alone is not enough: fds are only
+// unique within a process and are reused after close, so two different
+// processes (or the same process at different times) that happen to reuse
+// the same fd number would otherwise be ordered against each other. A
+// network attempt event whose pid can't be found in its common telemetry
+// data is keyed on its fd alone. Events that aren't network attempt events
+// are published without an ordering key.
+func pubSubOrderingKey(event TelemetryEvent) string {
+	var fd uint64
+	switch e := event.(type) {
+	case NetworkAcceptAttemptTelemetryEvent:
+		fd = e.FD
+	case NetworkBindAttemptTelemetryEvent:
+		fd = e.FD
+	case NetworkConnectAttemptTelemetryEvent:
+		fd = e.FD
+	case NetworkSendtoAttemptTelemetryEvent:
+		fd = e.FD
+	case NetworkRecvfromAttemptTelemetryEvent:
+		fd = e.FD
+	case NetworkListenAttemptTelemetryEvent:
+		fd = e.FD
+	default:
+		return ""
+	}
+	pid, ok := pubSubEventPid(event)
+	if !ok {
+		return fmt.Sprintf("%d", fd)
+	}
+	return fmt.Sprintf("%d/%d", pid, fd)
+}
+
+// pubSubPidFields lists the candidate TelemetryEventData JSON field names
+// for the originating pid. TelemetryEventData isn't defined in this
+// package (it lives alongside Subscription in the core sensor.go), so
+// rather than hard-code a Go struct field name that may not match, the
+// field is looked up by its JSON encoding, the same way
+// examples/telemetryd's routingAttributeFields does for its own "pid"
+// routing attribute.
+var pubSubPidFields = []string{"Pid", "PID", "pid"}
+
+// pubSubEventPid extracts the pid from event's common telemetry data, if
+// its concrete TelemetryEventData defines one of pubSubPidFields.
+func pubSubEventPid(event TelemetryEvent) (uint64, bool) {
+	raw, err := json.Marshal(event.CommonTelemetryEventData())
+	if err != nil {
+		return 0, false
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return 0, false
+	}
+	for _, name := range pubSubPidFields {
+		v, ok := fields[name]
+		if !ok {
+			continue
+		}
+		var pid uint64
+		if err := json.Unmarshal(v, &pid); err == nil {
+			return pid, true
+		}
+	}
+	return 0, false
+}
+
+// Close implements Emitter.
+func (e *PubSubEmitter) Close() error {
+	e.topic.Stop()
+	return nil
+}
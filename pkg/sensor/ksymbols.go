@@ -0,0 +1,198 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensor
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/capsule8/capsule8/pkg/sys"
+)
+
+// modulesPollInterval is how often /proc/modules' mtime is checked for
+// changes. Loading or unloading a kernel module can add or remove symbols,
+// so a cache populated before the change can't be trusted forever.
+const modulesPollInterval = 10 * time.Second
+
+// This file has no _test.go of its own: scan resolves every name through
+// sys.KernelSymbolAddresses, which parses the live /proc/kallsyms with no
+// seam to substitute a fake symbol table, so exercising the negative-cache
+// bookkeeping in isAvailable/scan would mean either asserting against
+// whatever symbols happen to exist on the test runner's kernel (flaky,
+// environment-dependent) or adding an indirection purely to make this
+// testable, which isn't how the rest of this package is built. The
+// invalidation poll in invalidateOnModuleChanges has the same issue one
+// layer further out, since it reads /proc/modules directly.
+
+// requiredKernelSymbols is a lazily-populated cache of kernel symbol
+// addresses. Rather than parsing the entire /proc/kallsyms up front (which
+// can be expensive on nodes with tens of thousands of symbols and loaded
+// modules), it only resolves the symbols subsystems have declared via
+// RegisterRequiredSymbols, doing the first /proc/kallsyms parse exactly once
+// after all of them have been declared. A query for a symbol outside the
+// declared set triggers a single rescan that also picks up the newly
+// queried name, so later ad hoc queries still work, just without the
+// up-front guarantee. Symbols confirmed absent are remembered too (in
+// missing), so repeat queries for a name that doesn't exist on this kernel
+// don't each trigger their own rescan; invalidateOnModuleChanges clears that
+// memory whenever /proc/modules changes, since a module load/unload can make
+// the answer for a given name stale in either direction.
+type requiredKernelSymbols struct {
+	mu       sync.RWMutex
+	required map[string]struct{}
+	resolved map[string]uint64
+	missing  map[string]struct{}
+}
+
+func newRequiredKernelSymbols() *requiredKernelSymbols {
+	k := &requiredKernelSymbols{
+		required: make(map[string]struct{}),
+		resolved: make(map[string]uint64),
+		missing:  make(map[string]struct{}),
+	}
+	go k.invalidateOnModuleChanges()
+	return k
+}
+
+// addRequired declares names as symbols that should be resolved the next
+// time (or, if a scan has already happened, the very next time) kallsyms is
+// parsed.
+func (k *requiredKernelSymbols) addRequired(names []string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, name := range names {
+		k.required[name] = struct{}{}
+	}
+}
+
+// isAvailable reports whether name is a live kernel symbol. If name hasn't
+// been resolved yet, it triggers a kallsyms scan: the first one ever if
+// nothing has been scanned yet (resolving every symbol registered via
+// addRequired up to that point, plus name itself), or, if a scan has already
+// happened but name wasn't part of the original required set, a rescan that
+// resolves the whole required set again with name added to it. If a prior scan already confirmed name doesn't
+// exist on this kernel, that negative result is returned directly instead of
+// triggering another rescan; invalidateOnModuleChanges is what eventually
+// forgets it.
+func (k *requiredKernelSymbols) isAvailable(name string) bool {
+	k.mu.RLock()
+	_, ok := k.resolved[name]
+	_, known := k.missing[name]
+	k.mu.RUnlock()
+	if ok {
+		return true
+	}
+	if known {
+		return false
+	}
+
+	k.scan([]string{name})
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	_, ok = k.resolved[name]
+	return ok
+}
+
+// scan parses /proc/kallsyms once, resolving every symbol in the required
+// set plus any names given in extra, and records the result so repeat
+// queries don't trigger another parse. Names that don't resolve are recorded
+// in missing so a repeat query for the same absent name is answered from
+// cache too, rather than triggering its own rescan.
+func (k *requiredKernelSymbols) scan(extra []string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	wanted := make(map[string]struct{}, len(k.required)+len(extra))
+	for name := range k.required {
+		wanted[name] = struct{}{}
+	}
+	for _, name := range extra {
+		wanted[name] = struct{}{}
+		k.required[name] = struct{}{}
+	}
+
+	addrs := sys.KernelSymbolAddresses(wanted)
+	for name, addr := range addrs {
+		k.resolved[name] = addr
+		delete(k.missing, name)
+	}
+	for name := range wanted {
+		if _, ok := addrs[name]; !ok {
+			k.missing[name] = struct{}{}
+		}
+	}
+}
+
+// invalidateOnModuleChanges polls /proc/modules' mtime every
+// modulesPollInterval and, on a change, drops every cached result so the
+// next query for any symbol reflects the currently-loaded modules instead of
+// a stale answer from before the load/unload. It runs for the life of the
+// process: this cache is meant to live as long as the Sensor that owns it,
+// and a sensor process runs until it's killed, so there's no narrower
+// lifetime to tie the poll loop to.
+func (k *requiredKernelSymbols) invalidateOnModuleChanges() {
+	var lastMtime time.Time
+	if fi, err := os.Stat("/proc/modules"); err == nil {
+		lastMtime = fi.ModTime()
+	}
+
+	ticker := time.NewTicker(modulesPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		fi, err := os.Stat("/proc/modules")
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().Equal(lastMtime) {
+			continue
+		}
+		lastMtime = fi.ModTime()
+
+		k.mu.Lock()
+		k.resolved = make(map[string]uint64)
+		k.missing = make(map[string]struct{})
+		k.mu.Unlock()
+	}
+}
+
+var kernelSymbolCaches sync.Map // map[*Sensor]*requiredKernelSymbols
+
+func kernelSymbolCacheFor(s *Sensor) *requiredKernelSymbols {
+	if v, ok := kernelSymbolCaches.Load(s); ok {
+		return v.(*requiredKernelSymbols)
+	}
+	k := newRequiredKernelSymbols()
+	v, _ := kernelSymbolCaches.LoadOrStore(s, k)
+	return v.(*requiredKernelSymbols)
+}
+
+// RegisterRequiredSymbols declares the kernel symbols a subsystem (syscall,
+// process, network, ...) needs resolved during sensor startup. Call it for
+// every symbol a subsystem might query via IsKernelSymbolAvailable before
+// the sensor starts registering events, so that the first /proc/kallsyms
+// parse resolves them all in a single pass instead of one rescan per
+// subsystem.
+func (s *Sensor) RegisterRequiredSymbols(names []string) {
+	kernelSymbolCacheFor(s).addRequired(names)
+}
+
+// IsKernelSymbolAvailable reports whether name is a live kernel symbol,
+// consulting (and, if necessary, populating) the sensor's lazy kernel
+// symbol cache rather than eagerly parsing the full kallsyms table.
+func (s *Sensor) IsKernelSymbolAvailable(name string) bool {
+	return kernelSymbolCacheFor(s).isAvailable(name)
+}
@@ -15,6 +15,8 @@
 package sensor
 
 import (
+	"net"
+
 	"github.com/capsule8/capsule8/pkg/expression"
 	"github.com/capsule8/capsule8/pkg/sys/perf"
 
@@ -40,6 +42,8 @@ var NetworkAttemptWithAddressEventTypes = expression.FieldTypeMap{
 	"sin6_port":      expression.ValueTypeUnsignedInt16,
 	"sin6_addr_high": expression.ValueTypeUnsignedInt64,
 	"sin6_addr_low":  expression.ValueTypeUnsignedInt64,
+	"hostname":       expression.ValueTypeString,
+	"service_name":   expression.ValueTypeString,
 }
 
 // NetworkListenAttemptEventTypes defines the field types that can be used with
@@ -75,6 +79,15 @@ type NetworkAddressTelemetryEventData struct {
 	IPv6AddressHigh uint64
 	IPv6AddressLow  uint64
 	IPv6Port        uint16
+
+	// IPAddress, Hostname, and ServiceName are derived fields, filled in
+	// by enrichAddress after initWithSample has decoded the raw address. They
+	// are zero-valued for AF_LOCAL addresses, and Hostname/ServiceName
+	// are empty whenever no resolver is registered or the name isn't yet
+	// in its cache; see network_resolve.go.
+	IPAddress   net.IP
+	Hostname    string
+	ServiceName string
 }
 
 func (ted *NetworkAddressTelemetryEventData) initWithSample(sample *perf.Sample) {
@@ -292,7 +305,10 @@ const (
 func (s *Subscription) handleSysEnterAccept(eventid uint64, sample *perf.Sample) {
 	var e NetworkAcceptAttemptTelemetryEvent
 	if e.InitWithSample(s.sensor, sample) {
-		e.NetworkAttemptTelemetryEventData.initWithSample(sample)
+		scratch := getNetworkAttemptScratch()
+		scratch.attempt.initWithSample(sample)
+		e.NetworkAttemptTelemetryEventData = scratch.attempt
+		putNetworkAttemptScratch(scratch)
 		s.DispatchEvent(eventid, e, nil)
 	}
 }
@@ -308,8 +324,13 @@ func (s *Subscription) handleSysExitAccept(eventid uint64, sample *perf.Sample)
 func (s *Subscription) handleSysBind(eventid uint64, sample *perf.Sample) {
 	var e NetworkBindAttemptTelemetryEvent
 	if e.InitWithSample(s.sensor, sample) {
-		e.NetworkAttemptTelemetryEventData.initWithSample(sample)
-		e.NetworkAddressTelemetryEventData.initWithSample(sample)
+		scratch := getNetworkAttemptScratch()
+		scratch.attempt.initWithSample(sample)
+		scratch.addr.initWithSample(sample)
+		e.NetworkAttemptTelemetryEventData = scratch.attempt
+		e.NetworkAddressTelemetryEventData = scratch.addr
+		putNetworkAttemptScratch(scratch)
+		s.enrichAddress(&e.NetworkAddressTelemetryEventData)
 		s.DispatchEvent(eventid, e, nil)
 	}
 }
@@ -325,8 +346,13 @@ func (s *Subscription) handleSysExitBind(eventid uint64, sample *perf.Sample) {
 func (s *Subscription) handleSysConnect(eventid uint64, sample *perf.Sample) {
 	var e NetworkConnectAttemptTelemetryEvent
 	if e.InitWithSample(s.sensor, sample) {
-		e.NetworkAttemptTelemetryEventData.initWithSample(sample)
-		e.NetworkAddressTelemetryEventData.initWithSample(sample)
+		scratch := getNetworkAttemptScratch()
+		scratch.attempt.initWithSample(sample)
+		scratch.addr.initWithSample(sample)
+		e.NetworkAttemptTelemetryEventData = scratch.attempt
+		e.NetworkAddressTelemetryEventData = scratch.addr
+		putNetworkAttemptScratch(scratch)
+		s.enrichAddress(&e.NetworkAddressTelemetryEventData)
 		s.DispatchEvent(eventid, e, nil)
 	}
 }
@@ -375,8 +401,13 @@ func (s *Subscription) handleSysExitRecvfrom(eventid uint64, sample *perf.Sample
 func (s *Subscription) handleSysSendto(eventid uint64, sample *perf.Sample) {
 	var e NetworkSendtoAttemptTelemetryEvent
 	if e.InitWithSample(s.sensor, sample) {
-		e.NetworkAttemptTelemetryEventData.initWithSample(sample)
-		e.NetworkAddressTelemetryEventData.initWithSample(sample)
+		scratch := getNetworkAttemptScratch()
+		scratch.attempt.initWithSample(sample)
+		scratch.addr.initWithSample(sample)
+		e.NetworkAttemptTelemetryEventData = scratch.attempt
+		e.NetworkAddressTelemetryEventData = scratch.addr
+		putNetworkAttemptScratch(scratch)
+		s.enrichAddress(&e.NetworkAddressTelemetryEventData)
 		s.DispatchEvent(eventid, e, nil)
 	}
 }
@@ -410,8 +441,11 @@ func (s *Subscription) RegisterNetworkAcceptResultEventFilter(expr *expression.E
 // RegisterNetworkBindAttemptEventFilter registers a network bind attempt event
 // filter with a subscription.
 func (s *Subscription) RegisterNetworkBindAttemptEventFilter(expr *expression.Expression) {
-	s.registerKprobe(networkKprobeBindSymbol, false,
+	es, err := s.registerKprobe(networkKprobeBindSymbol, false,
 		networkKprobeBindFetchargs, s.handleSysBind, expr, false)
+	if err == nil {
+		es.unregister = func(*eventSink) { deleteAddressResolver(s) }
+	}
 }
 
 // RegisterNetworkBindResultEventFilter registers a network bind result event
@@ -424,8 +458,11 @@ func (s *Subscription) RegisterNetworkBindResultEventFilter(expr *expression.Exp
 // RegisterNetworkConnectAttemptEventFilter registers a network connect attempt
 // event filter with a subscription.
 func (s *Subscription) RegisterNetworkConnectAttemptEventFilter(expr *expression.Expression) {
-	s.registerKprobe(networkKprobeConnectSymbol, false,
+	es, err := s.registerKprobe(networkKprobeConnectSymbol, false,
 		networkKprobeConnectFetchargs, s.handleSysConnect, expr, false)
+	if err == nil {
+		es.unregister = func(*eventSink) { deleteAddressResolver(s) }
+	}
 }
 
 // RegisterNetworkConnectResultEventFilter registers a network connect result
@@ -472,8 +509,11 @@ func (s *Subscription) RegisterNetworkRecvfromResultEventFilter(expr *expression
 func (s *Subscription) RegisterNetworkSendtoAttemptEventFilter(expr *expression.Expression) {
 	s.registerKprobe(networkKprobeSendmsgSymbol, false,
 		networkKprobeSendmsgFetchargs, s.handleSysSendto, expr, false)
-	s.registerKprobe(networkKprobeSendtoSymbol, false,
+	es, err := s.registerKprobe(networkKprobeSendtoSymbol, false,
 		networkKprobeSendtoFetchargs, s.handleSysSendto, expr, false)
+	if err == nil {
+		es.unregister = func(*eventSink) { deleteAddressResolver(s) }
+	}
 }
 
 // RegisterNetworkSendtoResultEventFilter registers a network sendto result
@@ -0,0 +1,61 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensor
+
+// This file benchmarks the parts of the network handler hot path that this
+// package owns outright: the scratch-struct pool introduced in
+// network_pool.go, and the flow correlation table from network_flow.go.
+// That pool is object reuse, not the zero-copy raw-buffer decode the batched
+// perf-ring redesign calls for; handlers still decode field-by-field via
+// sample.GetUnsignedInt* (see network.go), nothing batches N samples per
+// ring wakeup, and the expression filter still runs after the event is
+// materialized rather than before. None of that redesign is implemented in
+// this tree, only the scratch-pool slice of it, so this file intentionally
+// does not claim to benchmark it.
+//
+// It also does not replay recorded perf ring buffers through
+// handleSysConnect/handleSysSendto/handleSysEnterAccept themselves (all
+// three are defined in network.go): doing so requires constructing a
+// *perf.Sample, and pkg/sys/perf isn't vendored into this tree, so there is
+// no real sample layout to construct one against here; faking it would risk
+// benchmarking something that doesn't match the real decoder. Once
+// pkg/sys/perf is vendored (e.g. bringing in a recorded-sample helper like
+// pkg/sys/perf/perftest), this file is the place to add
+// BenchmarkHandleSysConnect and friends.
+
+import "testing"
+
+func BenchmarkNetworkAttemptScratchPool(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s := getNetworkAttemptScratch()
+		s.attempt.FD = uint64(i)
+		putNetworkAttemptScratch(s)
+	}
+}
+
+func BenchmarkNetworkFlowTableLifecycle(b *testing.B) {
+	b.ReportAllocs()
+	table := newNetworkFlowTable()
+	var data TelemetryEventData
+
+	for i := 0; i < b.N; i++ {
+		key := networkFlowKey{pid: 1, fd: uint64(i % networkFlowMaxEntries)}
+		table.startAttempt(key, 1, "outbound", data, uint64(i))
+		table.setResult(key, 0)
+		table.addBytes(key, 128, 0)
+		table.closeFlow(key)
+	}
+}
@@ -0,0 +1,529 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensor
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/capsule8/capsule8/pkg/expression"
+	"github.com/capsule8/capsule8/pkg/sys/perf"
+)
+
+// networkFlowMaxEntries bounds the number of in-flight flow records kept
+// per subscription, evicting the least recently touched entry once
+// exceeded, so a subscription can't be made to grow without bound by a
+// process that opens sockets and never closes them.
+const networkFlowMaxEntries = 65536
+
+// NetworkFlowEventTypes defines the field types that can be used with
+// filters on network flow telemetry events.
+var NetworkFlowEventTypes = expression.FieldTypeMap{
+	"fd":            expression.ValueTypeUnsignedInt64,
+	"direction":     expression.ValueTypeString,
+	"bytes_tx":      expression.ValueTypeUnsignedInt64,
+	"bytes_rx":      expression.ValueTypeUnsignedInt64,
+	"duration_ns":   expression.ValueTypeSignedInt64,
+	"exit_status":   expression.ValueTypeSignedInt64,
+	"sa_family":     expression.ValueTypeUnsignedInt16,
+	"sin_port":      expression.ValueTypeUnsignedInt16,
+	"sin_addr":      expression.ValueTypeUnsignedInt32,
+	"sin6_port":     expression.ValueTypeUnsignedInt16,
+}
+
+// NetworkFlowTelemetryEvent is a telemetry event generated when a socket is
+// closed, correlating its connect/accept/bind attempt and result with the
+// sendto/recvfrom byte counts observed over its lifetime.
+type NetworkFlowTelemetryEvent struct {
+	TelemetryEventData
+	NetworkAttemptTelemetryEventData
+	NetworkAddressTelemetryEventData
+
+	// Direction is "outbound" for a connect()ed socket, "inbound" for an
+	// accept()ed or bind()+listen()ing socket.
+	Direction     string
+	BytesTx       uint64
+	BytesRx       uint64
+	DurationNanos int64
+	ExitStatus    int64
+}
+
+// CommonTelemetryEventData returns the telemtry event data common to all
+// telemetry events for a chargen telemetry event.
+func (e NetworkFlowTelemetryEvent) CommonTelemetryEventData() TelemetryEventData {
+	return e.TelemetryEventData
+}
+
+// networkFlowKey identifies a socket by the task that owns it and its file
+// descriptor number. fds are only unique within a process, and are reused
+// after close, so both fields are needed.
+type networkFlowKey struct {
+	pid uint32
+	fd  uint64
+}
+
+// networkFlowRecord is the in-flight state tracked for one socket between
+// its attempt (connect/bind/accept) and its close.
+type networkFlowRecord struct {
+	data        TelemetryEventData
+	direction   string
+	addr        NetworkAddressTelemetryEventData
+	attemptTid  uint32
+	attemptTime uint64
+	haveResult  bool
+	exitStatus  int64
+	bytesTx     uint64
+	bytesRx     uint64
+}
+
+// pendingFlowKey identifies the task whose most recent connect/bind/accept
+// attempt is awaiting its result. It is scoped to (pid, tid), not just pid,
+// because a multi-threaded process can have several attempts in flight
+// concurrently, one per thread; tid is what the kernel itself serializes
+// enter/exit pairs on, the same reasoning pendingSyscallKey in syscall.go
+// uses for syscall enter/exit correlation.
+type pendingFlowKey struct {
+	pid uint32
+	tid uint32
+}
+
+// networkFlowTable tracks in-flight sockets for one subscription, keyed by
+// (pid, fd), with an LRU eviction cap.
+type networkFlowTable struct {
+	mu      sync.Mutex
+	records map[networkFlowKey]*networkFlowRecord
+	lru     *list.List
+	index   map[networkFlowKey]*list.Element
+
+	// pending maps a task to the networkFlowKey of its most recently
+	// started attempt that hasn't seen a result yet, so handleFlowResult
+	// can look its fd up directly instead of scanning every in-flight
+	// record on the subscription.
+	pending map[pendingFlowKey]networkFlowKey
+
+	// pendingAccepts holds the record for an in-flight accept() call,
+	// keyed by the calling task rather than by fd. accept()'s enter-time
+	// fd argument is the listening socket, shared by every concurrent
+	// accept() on it, so unlike connect/bind it can't key the
+	// per-connection record the way the other attempts' enter-time fd
+	// does: two concurrent accepts on the same listening socket would
+	// otherwise collide on the same records entry. The real
+	// per-connection fd is only known from accept's return value, so the
+	// record only moves into records, keyed by that fd, once
+	// acceptResult observes it.
+	pendingAccepts map[pendingFlowKey]*networkFlowRecord
+
+	// filter is evaluated in Go against the fully-correlated
+	// NetworkFlowTelemetryEvent in handleFlowClose, not handed to any
+	// single kernel probe: its fields (bytes_tx, duration_ns, ...) are
+	// aggregates this table computes across several raw events, and no
+	// one probe carries them. See RegisterNetworkFlowEventFilter.
+	filter *expression.Expression
+}
+
+func newNetworkFlowTable() *networkFlowTable {
+	return &networkFlowTable{
+		records:        make(map[networkFlowKey]*networkFlowRecord),
+		lru:            list.New(),
+		index:          make(map[networkFlowKey]*list.Element),
+		pending:        make(map[pendingFlowKey]networkFlowKey),
+		pendingAccepts: make(map[pendingFlowKey]*networkFlowRecord),
+	}
+}
+
+func (t *networkFlowTable) touch(key networkFlowKey) {
+	if el, ok := t.index[key]; ok {
+		t.lru.MoveToFront(el)
+		return
+	}
+	t.index[key] = t.lru.PushFront(key)
+	if t.lru.Len() > networkFlowMaxEntries {
+		t.evictOldest()
+	}
+}
+
+func (t *networkFlowTable) evictOldest() {
+	el := t.lru.Back()
+	if el == nil {
+		return
+	}
+	key := el.Value.(networkFlowKey)
+	t.lru.Remove(el)
+	delete(t.index, key)
+	t.forgetPending(key)
+	delete(t.records, key)
+}
+
+// forgetPending drops the pending-result entry for key's attempt, if it is
+// still the most recent one for that task. Called whenever key's record is
+// removed (evicted, closed, or the owning process exits) without ever
+// having gone through popPendingResult, so a lost result tracepoint can't
+// leave a stale entry in t.pending forever.
+func (t *networkFlowTable) forgetPending(key networkFlowKey) {
+	r, ok := t.records[key]
+	if !ok {
+		return
+	}
+	pk := pendingFlowKey{pid: key.pid, tid: r.attemptTid}
+	if t.pending[pk] == key {
+		delete(t.pending, pk)
+	}
+}
+
+func (t *networkFlowTable) startAttempt(key networkFlowKey, tid uint32, direction string, data TelemetryEventData, attemptTime uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.records[key] = &networkFlowRecord{
+		data:        data,
+		direction:   direction,
+		attemptTid:  tid,
+		attemptTime: attemptTime,
+	}
+	t.touch(key)
+	t.pending[pendingFlowKey{pid: key.pid, tid: tid}] = key
+}
+
+// popPendingResult returns (and forgets) the networkFlowKey of the most
+// recently started attempt on (pid, tid) that hasn't seen a result yet.
+func (t *networkFlowTable) popPendingResult(pid, tid uint32) (networkFlowKey, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pk := pendingFlowKey{pid: pid, tid: tid}
+	key, ok := t.pending[pk]
+	if ok {
+		delete(t.pending, pk)
+	}
+	return key, ok
+}
+
+// startAccept records the start of an accept() call on (pid, tid). Unlike
+// startAttempt, it is not keyed by fd: see the pendingAccepts field comment.
+func (t *networkFlowTable) startAccept(pid, tid uint32, data TelemetryEventData, attemptTime uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pendingAccepts[pendingFlowKey{pid: pid, tid: tid}] = &networkFlowRecord{
+		data:        data,
+		direction:   "inbound",
+		attemptTid:  tid,
+		attemptTime: attemptTime,
+	}
+}
+
+// acceptResult moves the pending accept record for (pid, tid), if any, into
+// records keyed by fd, the accepted connection's fd, now that accept's
+// return value has made it known. status is accept's raw return value: a
+// negative status means the call failed, so there is no connection fd to
+// key the record under, and it is dropped instead. Returns whether a
+// pending accept record for (pid, tid) was found.
+func (t *networkFlowTable) acceptResult(pid, tid uint32, fd uint64, status int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pk := pendingFlowKey{pid: pid, tid: tid}
+	r, ok := t.pendingAccepts[pk]
+	if !ok {
+		return false
+	}
+	delete(t.pendingAccepts, pk)
+	if status < 0 {
+		return true
+	}
+
+	r.haveResult = true
+	r.exitStatus = status
+	key := networkFlowKey{pid: pid, fd: fd}
+	t.records[key] = r
+	t.touch(key)
+	return true
+}
+
+func (t *networkFlowTable) setAddress(key networkFlowKey, addr NetworkAddressTelemetryEventData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r, ok := t.records[key]; ok {
+		r.addr = addr
+		t.touch(key)
+	}
+}
+
+func (t *networkFlowTable) setResult(key networkFlowKey, status int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r, ok := t.records[key]; ok {
+		r.haveResult = true
+		r.exitStatus = status
+		t.touch(key)
+	}
+}
+
+func (t *networkFlowTable) addBytes(key networkFlowKey, tx, rx uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r, ok := t.records[key]; ok {
+		r.bytesTx += tx
+		r.bytesRx += rx
+		t.touch(key)
+	}
+}
+
+// closeFlow removes and returns the record for key, if any, to be turned
+// into a NetworkFlowTelemetryEvent by the caller.
+func (t *networkFlowTable) closeFlow(key networkFlowKey) (*networkFlowRecord, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.records[key]
+	if !ok {
+		return nil, false
+	}
+	t.forgetPending(key)
+	delete(t.records, key)
+	if el, ok := t.index[key]; ok {
+		t.lru.Remove(el)
+		delete(t.index, key)
+	}
+	return r, true
+}
+
+// evictProcess drops every record belonging to pid, since a process that
+// has exited can never close its remaining fds itself, or observe the
+// result of an accept() it had in flight.
+func (t *networkFlowTable) evictProcess(pid uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key := range t.records {
+		if key.pid == pid {
+			t.forgetPending(key)
+			delete(t.records, key)
+			if el, ok := t.index[key]; ok {
+				t.lru.Remove(el)
+				delete(t.index, key)
+			}
+		}
+	}
+	for pk := range t.pendingAccepts {
+		if pk.pid == pid {
+			delete(t.pendingAccepts, pk)
+		}
+	}
+}
+
+// networkFlowTableFor returns the networkFlowTable for s, creating it on
+// first use. Like the syscall correlation stacks, this is keyed off the
+// Subscription itself rather than being a field on it, keeping the
+// subsystem self-contained in this file.
+var (
+	networkFlowTablesMu sync.Mutex
+	networkFlowTables   = map[*Subscription]*networkFlowTable{}
+)
+
+func networkFlowTableFor(s *Subscription) *networkFlowTable {
+	networkFlowTablesMu.Lock()
+	defer networkFlowTablesMu.Unlock()
+	t, ok := networkFlowTables[s]
+	if !ok {
+		t = newNetworkFlowTable()
+		networkFlowTables[s] = t
+	}
+	return t
+}
+
+// deleteNetworkFlowTable drops s's networkFlowTable, called once its
+// process-exit probe is torn down (see RegisterNetworkFlowEventFilter) so
+// that a subscription's entry in networkFlowTables doesn't outlive the
+// subscription itself.
+func deleteNetworkFlowTable(s *Subscription) {
+	networkFlowTablesMu.Lock()
+	delete(networkFlowTables, s)
+	networkFlowTablesMu.Unlock()
+}
+
+func (s *Subscription) handleFlowConnectAttempt(eventid uint64, sample *perf.Sample) {
+	var attempt NetworkAttemptTelemetryEventData
+	attempt.initWithSample(sample)
+	var addr NetworkAddressTelemetryEventData
+	addr.initWithSample(sample)
+
+	var data TelemetryEventData
+	data.InitWithSample(s.sensor, sample)
+
+	key := networkFlowKey{pid: sample.Pid, fd: attempt.FD}
+	table := networkFlowTableFor(s)
+	table.startAttempt(key, sample.Tid, "outbound", data, sample.Time)
+	table.setAddress(key, addr)
+}
+
+func (s *Subscription) handleFlowAcceptAttempt(eventid uint64, sample *perf.Sample) {
+	var data TelemetryEventData
+	data.InitWithSample(s.sensor, sample)
+
+	networkFlowTableFor(s).startAccept(sample.Pid, sample.Tid, data, sample.Time)
+}
+
+func (s *Subscription) handleFlowBindAttempt(eventid uint64, sample *perf.Sample) {
+	var attempt NetworkAttemptTelemetryEventData
+	attempt.initWithSample(sample)
+	var addr NetworkAddressTelemetryEventData
+	addr.initWithSample(sample)
+
+	var data TelemetryEventData
+	data.InitWithSample(s.sensor, sample)
+
+	key := networkFlowKey{pid: sample.Pid, fd: attempt.FD}
+	table := networkFlowTableFor(s)
+	table.startAttempt(key, sample.Tid, "inbound", data, sample.Time)
+	table.setAddress(key, addr)
+}
+
+// handleFlowResult is shared by the connect/bind result tracepoints; they
+// all report the same (fd-less) "ret" field, so the fd has to come from the
+// matching task's most recently started attempt, looked up by (pid, tid)
+// via popPendingResult. Matching on pid alone would cross-wire concurrent
+// connect/bind calls from different threads of the same multi-threaded
+// process onto each other's results.
+//
+// accept's result is handled separately by handleFlowAcceptResult: unlike
+// connect/bind, accept's enter-time fd is the listening socket rather than
+// the fd its record needs to be keyed by, so it cannot share
+// popPendingResult/setResult's "fd already known, just record the status"
+// logic.
+func (s *Subscription) handleFlowResult(eventid uint64, sample *perf.Sample) {
+	ret, _ := sample.GetSignedInt64("ret")
+	table := networkFlowTableFor(s)
+	if key, ok := table.popPendingResult(sample.Pid, sample.Tid); ok {
+		table.setResult(key, ret)
+	}
+}
+
+// handleFlowAcceptResult resolves the accept() call pending on (pid, tid),
+// now that its return value — the accepted connection's fd, or a negative
+// errno on failure — is known. See networkFlowTable.pendingAccepts.
+func (s *Subscription) handleFlowAcceptResult(eventid uint64, sample *perf.Sample) {
+	ret, _ := sample.GetSignedInt64("ret")
+	var fd uint64
+	if ret >= 0 {
+		fd = uint64(ret)
+	}
+	networkFlowTableFor(s).acceptResult(sample.Pid, sample.Tid, fd, ret)
+}
+
+func (s *Subscription) handleFlowSendto(eventid uint64, sample *perf.Sample) {
+	var attempt NetworkAttemptTelemetryEventData
+	attempt.initWithSample(sample)
+	key := networkFlowKey{pid: sample.Pid, fd: attempt.FD}
+	count, _ := sample.GetUnsignedInt64("count")
+	networkFlowTableFor(s).addBytes(key, count, 0)
+}
+
+func (s *Subscription) handleFlowRecvfrom(eventid uint64, sample *perf.Sample) {
+	var attempt NetworkAttemptTelemetryEventData
+	attempt.initWithSample(sample)
+	key := networkFlowKey{pid: sample.Pid, fd: attempt.FD}
+	count, _ := sample.GetUnsignedInt64("count")
+	networkFlowTableFor(s).addBytes(key, 0, count)
+}
+
+func (s *Subscription) handleFlowClose(eventid uint64, sample *perf.Sample) {
+	fd, _ := sample.GetUnsignedInt64("fd")
+	key := networkFlowKey{pid: sample.Pid, fd: fd}
+
+	table := networkFlowTableFor(s)
+	record, ok := table.closeFlow(key)
+	if !ok {
+		return
+	}
+
+	var e NetworkFlowTelemetryEvent
+	e.TelemetryEventData = record.data
+	e.FD = fd
+	e.Direction = record.direction
+	e.NetworkAddressTelemetryEventData = record.addr
+	e.BytesTx = record.bytesTx
+	e.BytesRx = record.bytesRx
+	e.DurationNanos = int64(sample.Time - record.attemptTime)
+	e.ExitStatus = record.exitStatus
+
+	if table.filter != nil {
+		matched, err := table.filter.Evaluate(networkFlowFieldValues(e))
+		if err != nil || !matched {
+			return
+		}
+	}
+
+	s.DispatchEvent(eventid, e, nil)
+}
+
+// networkFlowFieldValues builds the field values a NetworkFlowEventTypes
+// filter is evaluated against from a fully-correlated
+// NetworkFlowTelemetryEvent, mirroring the field names declared in
+// NetworkFlowEventTypes.
+func networkFlowFieldValues(e NetworkFlowTelemetryEvent) expression.FieldValueMap {
+	return expression.FieldValueMap{
+		"fd":          e.FD,
+		"direction":   e.Direction,
+		"bytes_tx":    e.BytesTx,
+		"bytes_rx":    e.BytesRx,
+		"duration_ns": e.DurationNanos,
+		"exit_status": e.ExitStatus,
+		"sa_family":   e.Family,
+		"sin_port":    e.IPv4Port,
+		"sin_addr":    e.IPv4Address,
+		"sin6_port":   e.IPv6Port,
+	}
+}
+
+func (s *Subscription) handleFlowProcessExit(eventid uint64, sample *perf.Sample) {
+	networkFlowTableFor(s).evictProcess(sample.Pid)
+}
+
+// RegisterNetworkFlowEventFilter registers a network flow event filter with
+// a subscription. It correlates the raw attempt/result/sendto/recvfrom
+// events already exposed by this package into one NetworkFlowTelemetryEvent
+// per socket, delivered when the socket is closed, so that filters can
+// reference aggregate fields (bytes_tx, duration_ns, ...) that no single
+// raw event carries.
+//
+// Unlike the filters on the raw per-probe event sources in network.go,
+// filter is not handed to any kernel probe: none of them individually
+// carries the aggregate fields it may reference, since those are only
+// known once this package has correlated several raw events together. It
+// is instead evaluated in Go, in handleFlowClose, against the fully
+// populated NetworkFlowTelemetryEvent once that correlation is done.
+func (s *Subscription) RegisterNetworkFlowEventFilter(filter *expression.Expression) {
+	networkFlowTableFor(s).filter = filter
+
+	s.registerKprobe(networkKprobeConnectSymbol, false,
+		networkKprobeConnectFetchargs, s.handleFlowConnectAttempt, nil, false)
+	s.registerTracepoint("syscalls/sys_exit_connect", s.handleFlowResult, nil)
+
+	s.registerTracepoint("syscalls/sys_enter_accept", s.handleFlowAcceptAttempt, nil)
+	s.registerTracepoint("syscalls/sys_enter_accept4", s.handleFlowAcceptAttempt, nil)
+	s.registerTracepoint("syscalls/sys_exit_accept", s.handleFlowAcceptResult, nil)
+	s.registerTracepoint("syscalls/sys_exit_accept4", s.handleFlowAcceptResult, nil)
+
+	s.registerKprobe(networkKprobeBindSymbol, false,
+		networkKprobeBindFetchargs, s.handleFlowBindAttempt, nil, false)
+	s.registerTracepoint("syscalls/sys_exit_bind", s.handleFlowResult, nil)
+
+	s.registerKprobe(networkKprobeSendtoSymbol, false,
+		networkKprobeSendtoFetchargs, s.handleFlowSendto, nil, false)
+	s.registerTracepoint("syscalls/sys_enter_recvfrom", s.handleFlowRecvfrom, nil)
+	s.registerTracepoint("syscalls/sys_enter_recvmsg", s.handleFlowRecvfrom, nil)
+
+	s.registerTracepoint("syscalls/sys_enter_close", s.handleFlowClose, nil)
+
+	es, err := s.registerTracepoint("sched/sched_process_exit", s.handleFlowProcessExit, nil)
+	if err == nil {
+		es.unregister = func(*eventSink) { deleteNetworkFlowTable(s) }
+	}
+}
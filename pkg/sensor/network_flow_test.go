@@ -0,0 +1,239 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensor
+
+import "testing"
+
+// TestNetworkFlowTablePendingResultByThread verifies that a result is
+// matched to the attempt started by the same (pid, tid), not just any
+// attempt on the same pid, since a multi-threaded process can have several
+// connect/bind/accept calls in flight concurrently on different threads.
+func TestNetworkFlowTablePendingResultByThread(t *testing.T) {
+	tests := []struct {
+		name        string
+		attempts    []struct{ fd uint64; tid uint32 }
+		resultTid   uint32
+		wantFD      uint64
+		wantMatched bool
+	}{
+		{
+			name: "single thread matches its own attempt",
+			attempts: []struct {
+				fd  uint64
+				tid uint32
+			}{{fd: 3, tid: 100}},
+			resultTid:   100,
+			wantFD:      3,
+			wantMatched: true,
+		},
+		{
+			name: "second thread's attempt does not steal the first thread's result",
+			attempts: []struct {
+				fd  uint64
+				tid uint32
+			}{{fd: 3, tid: 100}, {fd: 4, tid: 200}},
+			resultTid:   100,
+			wantFD:      3,
+			wantMatched: true,
+		},
+		{
+			name: "result for a thread with no pending attempt is dropped",
+			attempts: []struct {
+				fd  uint64
+				tid uint32
+			}{{fd: 3, tid: 100}},
+			resultTid:   200,
+			wantMatched: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := newNetworkFlowTable()
+			var data TelemetryEventData
+			for _, a := range tt.attempts {
+				key := networkFlowKey{pid: 1, fd: a.fd}
+				table.startAttempt(key, a.tid, "outbound", data, 0)
+			}
+
+			key, ok := table.popPendingResult(1, tt.resultTid)
+			if ok != tt.wantMatched {
+				t.Fatalf("popPendingResult matched = %v, want %v", ok, tt.wantMatched)
+			}
+			if ok && key.fd != tt.wantFD {
+				t.Fatalf("popPendingResult fd = %d, want %d", key.fd, tt.wantFD)
+			}
+		})
+	}
+}
+
+// TestNetworkFlowTablePendingResultConsumedOnce verifies that a result can
+// only be matched to a given attempt once, so a duplicate or spurious
+// result tracepoint for the same task doesn't retroactively overwrite an
+// already-resolved attempt.
+func TestNetworkFlowTablePendingResultConsumedOnce(t *testing.T) {
+	table := newNetworkFlowTable()
+	var data TelemetryEventData
+	key := networkFlowKey{pid: 1, fd: 3}
+	table.startAttempt(key, 100, "outbound", data, 0)
+
+	if _, ok := table.popPendingResult(1, 100); !ok {
+		t.Fatalf("expected first popPendingResult to match")
+	}
+	if _, ok := table.popPendingResult(1, 100); ok {
+		t.Fatalf("expected second popPendingResult to find nothing pending")
+	}
+}
+
+// TestNetworkFlowTableForgetPendingOnEviction verifies that evicting a
+// record (via closeFlow or evictProcess) also drops its pending-result
+// bookkeeping, so a lost result tracepoint can't leave a stale entry that
+// later cross-wires onto an unrelated attempt from the same task.
+func TestNetworkFlowTableForgetPendingOnEviction(t *testing.T) {
+	table := newNetworkFlowTable()
+	var data TelemetryEventData
+	key := networkFlowKey{pid: 1, fd: 3}
+	table.startAttempt(key, 100, "outbound", data, 0)
+	table.closeFlow(key)
+
+	if _, ok := table.popPendingResult(1, 100); ok {
+		t.Fatalf("expected no pending result after closeFlow evicted the attempt")
+	}
+
+	table.startAttempt(key, 100, "outbound", data, 0)
+	table.evictProcess(1)
+	if _, ok := table.popPendingResult(1, 100); ok {
+		t.Fatalf("expected no pending result after evictProcess evicted the attempt")
+	}
+}
+
+// TestNetworkFlowTableAcceptEndToEnd verifies the full accept/result/close
+// sequence: startAccept's record is keyed by the calling task, not by any
+// fd, and only becomes reachable by the accepted connection's fd once
+// acceptResult observes accept's return value, after which closeFlow can
+// find and return it like any other record.
+func TestNetworkFlowTableAcceptEndToEnd(t *testing.T) {
+	table := newNetworkFlowTable()
+	var data TelemetryEventData
+	table.startAccept(1, 100, data, 0)
+
+	const acceptedFD = 7
+	if ok := table.acceptResult(1, 100, acceptedFD, acceptedFD); !ok {
+		t.Fatalf("acceptResult did not find the pending accept")
+	}
+
+	key := networkFlowKey{pid: 1, fd: acceptedFD}
+	table.addBytes(key, 0, 128)
+
+	record, ok := table.closeFlow(key)
+	if !ok {
+		t.Fatalf("closeFlow did not find a record keyed by the accepted fd")
+	}
+	if record.direction != "inbound" {
+		t.Errorf("record.direction = %q, want %q", record.direction, "inbound")
+	}
+	if record.bytesRx != 128 {
+		t.Errorf("record.bytesRx = %d, want %d", record.bytesRx, 128)
+	}
+}
+
+// TestNetworkFlowTableConcurrentAcceptsDoNotClobber verifies that two
+// concurrent accept() calls on the same listening socket, from different
+// threads of the same process, resolve to two independent records instead
+// of the second clobbering the first: both attempts share the same (pid,
+// listening fd), which is exactly why pendingAccepts keys on the calling
+// task rather than on fd.
+func TestNetworkFlowTableConcurrentAcceptsDoNotClobber(t *testing.T) {
+	table := newNetworkFlowTable()
+	var data TelemetryEventData
+	table.startAccept(1, 100, data, 0)
+	table.startAccept(1, 200, data, 0)
+
+	table.acceptResult(1, 100, 7, 7)
+	table.acceptResult(1, 200, 8, 8)
+
+	if _, ok := table.closeFlow(networkFlowKey{pid: 1, fd: 7}); !ok {
+		t.Errorf("expected a record for the first thread's accepted fd")
+	}
+	if _, ok := table.closeFlow(networkFlowKey{pid: 1, fd: 8}); !ok {
+		t.Errorf("expected a record for the second thread's accepted fd")
+	}
+}
+
+// TestNetworkFlowTableAcceptFailureDropsPending verifies that a failed
+// accept() (a negative return value) consumes the pending entry without
+// creating a record, since there is no connection fd to key one under.
+func TestNetworkFlowTableAcceptFailureDropsPending(t *testing.T) {
+	table := newNetworkFlowTable()
+	var data TelemetryEventData
+	table.startAccept(1, 100, data, 0)
+
+	if ok := table.acceptResult(1, 100, 0, -1); !ok {
+		t.Fatalf("acceptResult did not find the pending accept")
+	}
+	if _, ok := table.closeFlow(networkFlowKey{pid: 1, fd: 0}); ok {
+		t.Errorf("expected no record to have been created for a failed accept")
+	}
+}
+
+// TestNetworkFlowTableEvictProcessDropsPendingAccept verifies that
+// evictProcess also forgets a pending accept for the evicted pid, so a
+// process that exits mid-accept doesn't leave a stranded pendingAccepts
+// entry forever.
+func TestNetworkFlowTableEvictProcessDropsPendingAccept(t *testing.T) {
+	table := newNetworkFlowTable()
+	var data TelemetryEventData
+	table.startAccept(1, 100, data, 0)
+	table.evictProcess(1)
+
+	if ok := table.acceptResult(1, 100, 7, 7); ok {
+		t.Fatalf("expected no pending accept after evictProcess")
+	}
+}
+
+// TestNetworkFlowFieldValues verifies that networkFlowFieldValues maps a
+// NetworkFlowTelemetryEvent's fields under the same names NetworkFlowEventTypes
+// declares them under, since a filter is evaluated against this map, not the
+// struct directly.
+func TestNetworkFlowFieldValues(t *testing.T) {
+	var e NetworkFlowTelemetryEvent
+	e.FD = 3
+	e.Direction = "outbound"
+	e.BytesTx = 2 << 20
+	e.BytesRx = 512
+	e.DurationNanos = 1500
+	e.ExitStatus = 0
+	e.Family = 2 // AF_INET
+	e.IPv4Port = 443
+	e.IPv4Address = 0x7f000001
+
+	values := networkFlowFieldValues(e)
+	for field, want := range map[string]interface{}{
+		"fd":          e.FD,
+		"direction":   e.Direction,
+		"bytes_tx":    e.BytesTx,
+		"bytes_rx":    e.BytesRx,
+		"duration_ns": e.DurationNanos,
+		"exit_status": e.ExitStatus,
+		"sa_family":   e.Family,
+		"sin_port":    e.IPv4Port,
+		"sin_addr":    e.IPv4Address,
+		"sin6_port":   e.IPv6Port,
+	} {
+		if got := values[field]; got != want {
+			t.Errorf("values[%q] = %v, want %v", field, got, want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensor
+
+import "sync"
+
+// networkAttemptScratch bundles the attempt and address data decoded from
+// one sample before it is copied into the telemetry event that gets
+// dispatched. Decoding into a pooled scratch value instead of a fresh
+// struct literal per sample avoids an allocation on every network syscall
+// sample a subscription's kprobes/tracepoints deliver, which on a busy host
+// can be the majority of all samples seen by the sensor.
+type networkAttemptScratch struct {
+	attempt NetworkAttemptTelemetryEventData
+	addr    NetworkAddressTelemetryEventData
+}
+
+var networkAttemptScratchPool = sync.Pool{
+	New: func() interface{} { return new(networkAttemptScratch) },
+}
+
+// getNetworkAttemptScratch returns a zeroed networkAttemptScratch from the
+// pool. The caller must return it with putNetworkAttemptScratch once it has
+// copied out whatever fields it needs.
+func getNetworkAttemptScratch() *networkAttemptScratch {
+	s := networkAttemptScratchPool.Get().(*networkAttemptScratch)
+	*s = networkAttemptScratch{}
+	return s
+}
+
+func putNetworkAttemptScratch(s *networkAttemptScratch) {
+	networkAttemptScratchPool.Put(s)
+}
@@ -0,0 +1,318 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensor
+
+import (
+	"bufio"
+	"container/list"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// addressResolverCacheSize bounds the number of hostnames and service names
+// an AddressResolver keeps cached, evicting the least recently used entry
+// once exceeded.
+const addressResolverCacheSize = 4096
+
+// addressResolverTTL is how long a cached reverse-DNS lookup is trusted
+// before it is resolved again.
+const addressResolverTTL = 10 * time.Minute
+
+// addressResolverMaxConcurrentLookups bounds how many reverse-DNS lookups
+// cachedAddressResolver runs at once. Without a bound, a burst of cache
+// misses (e.g. right after startup, or a host that talks to many distinct
+// addresses) would spawn one goroutine per miss, each potentially blocked
+// for however long a DNS query takes to time out.
+const addressResolverMaxConcurrentLookups = 16
+
+// addressResolverLookupQueueSize is how many pending lookups are queued
+// behind the fixed pool of addressResolverMaxConcurrentLookups workers
+// before Lookup starts dropping new ones (see cachedAddressResolver.submit).
+const addressResolverLookupQueueSize = addressResolverMaxConcurrentLookups * 4
+
+// AddressResolver enriches a NetworkAddressTelemetryEventData with a
+// hostname and/or service name for its address. Implementations must not
+// block the caller on network I/O; Lookup and ServiceName are called from
+// the sensor's sample-handling path and are expected to be cache lookups,
+// triggering any slow resolution asynchronously for later events.
+type AddressResolver interface {
+	// Lookup returns the cached hostname for ip, if any is known.
+	Lookup(ip net.IP) (hostname string, ok bool)
+
+	// ServiceName returns the cached /etc/services name for port/proto
+	// (proto is "tcp" or "udp"), if any is known.
+	ServiceName(port uint16, proto string) (name string, ok bool)
+}
+
+// subscriptionResolvers holds the AddressResolver registered on each
+// Subscription, keyed by *Subscription for the same reason as
+// networkFlowTables in network_flow.go: this subsystem stays self-contained
+// in this file rather than adding a field to Subscription itself.
+var (
+	subscriptionResolversMu sync.Mutex
+	subscriptionResolvers   = map[*Subscription]AddressResolver{}
+)
+
+// SetAddressResolver registers r as the AddressResolver used to populate
+// Hostname and ServiceName on this subscription's network address events.
+// Passing a nil r disables enrichment.
+func (s *Subscription) SetAddressResolver(r AddressResolver) {
+	subscriptionResolversMu.Lock()
+	defer subscriptionResolversMu.Unlock()
+	if r == nil {
+		delete(subscriptionResolvers, s)
+		return
+	}
+	subscriptionResolvers[s] = r
+}
+
+// deleteAddressResolver drops s's registered AddressResolver, called once
+// one of the probes that feeds enrichAddress is torn down (see
+// RegisterNetworkBindAttemptEventFilter, RegisterNetworkConnectAttemptEventFilter,
+// and RegisterNetworkSendtoAttemptEventFilter in network.go) so that a
+// subscription's entry in subscriptionResolvers doesn't outlive the
+// subscription itself.
+func deleteAddressResolver(s *Subscription) {
+	subscriptionResolversMu.Lock()
+	delete(subscriptionResolvers, s)
+	subscriptionResolversMu.Unlock()
+}
+
+// enrichAddress fills in the IPAddress, Hostname, and ServiceName fields of
+// ted based on the raw address fields already decoded by initWithSample. If
+// no AddressResolver is registered on s, only IPAddress is derived, since
+// that requires no I/O.
+func (s *Subscription) enrichAddress(ted *NetworkAddressTelemetryEventData) {
+	switch ted.Family {
+	case unix.AF_INET:
+		ted.IPAddress = net.IPv4(
+			byte(ted.IPv4Address>>24), byte(ted.IPv4Address>>16),
+			byte(ted.IPv4Address>>8), byte(ted.IPv4Address))
+	case unix.AF_INET6:
+		var b [16]byte
+		for i := 0; i < 8; i++ {
+			b[i] = byte(ted.IPv6AddressHigh >> uint(56-8*i))
+			b[8+i] = byte(ted.IPv6AddressLow >> uint(56-8*i))
+		}
+		ted.IPAddress = net.IP(b[:])
+	default:
+		return
+	}
+
+	subscriptionResolversMu.Lock()
+	r := subscriptionResolvers[s]
+	subscriptionResolversMu.Unlock()
+	if r == nil {
+		return
+	}
+
+	if hostname, ok := r.Lookup(ted.IPAddress); ok {
+		ted.Hostname = hostname
+	}
+
+	port := ted.IPv4Port
+	if ted.Family == unix.AF_INET6 {
+		port = ted.IPv6Port
+	}
+	if name, ok := r.ServiceName(port, "tcp"); ok {
+		ted.ServiceName = name
+	}
+}
+
+// cachedAddressResolver is the default AddressResolver, backed by a
+// size-bounded, TTL-expiring LRU cache of reverse-DNS lookups and the
+// system's /etc/services database for service names.
+type cachedAddressResolver struct {
+	mu    sync.Mutex
+	lru   *list.List
+	index map[string]*list.Element
+
+	services     map[string]string
+	servicesOnce sync.Once
+
+	lookups chan addressResolverLookup
+}
+
+// addressResolverLookup is one queued reverse-DNS lookup for a worker in the
+// fixed-size pool started by NewCachedAddressResolver to pick up.
+type addressResolverLookup struct {
+	key string
+	ip  net.IP
+}
+
+type addressResolverEntry struct {
+	key      string
+	hostname string
+	expires  time.Time
+	pending  bool
+}
+
+// NewCachedAddressResolver creates an AddressResolver that serves reverse
+// DNS lookups from a bounded, TTL-expiring cache, resolving cache misses on
+// a fixed pool of addressResolverMaxConcurrentLookups background workers so
+// that the calling sample-handling goroutine is never blocked on network
+// I/O, and a burst of misses can't spawn unbounded goroutines. Service names
+// are read from /etc/services.
+func NewCachedAddressResolver() AddressResolver {
+	r := &cachedAddressResolver{
+		lru:     list.New(),
+		index:   make(map[string]*list.Element),
+		lookups: make(chan addressResolverLookup, addressResolverLookupQueueSize),
+	}
+	for i := 0; i < addressResolverMaxConcurrentLookups; i++ {
+		go r.resolveWorker()
+	}
+	return r
+}
+
+// resolveWorker runs lookups submitted via submit until r.lookups is closed.
+// NewCachedAddressResolver starts addressResolverMaxConcurrentLookups of
+// these, bounding how many net.LookupAddr calls are in flight at once.
+func (r *cachedAddressResolver) resolveWorker() {
+	for lookup := range r.lookups {
+		r.resolve(lookup.key, lookup.ip)
+	}
+}
+
+// submit queues a reverse-DNS lookup for the worker pool. If every worker is
+// busy and the queue is already full, the lookup is dropped and the entry's
+// pending flag is cleared instead, so the next call to Lookup retries it
+// rather than leaving it stuck pending forever.
+func (r *cachedAddressResolver) submit(key string, ip net.IP) {
+	select {
+	case r.lookups <- addressResolverLookup{key: key, ip: ip}:
+	default:
+		r.mu.Lock()
+		if el, ok := r.index[key]; ok {
+			el.Value.(*addressResolverEntry).pending = false
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *cachedAddressResolver) Lookup(ip net.IP) (string, bool) {
+	key := ip.String()
+
+	r.mu.Lock()
+	el, ok := r.index[key]
+	if ok {
+		entry := el.Value.(*addressResolverEntry)
+		r.lru.MoveToFront(el)
+		if entry.pending {
+			r.mu.Unlock()
+			return "", false
+		}
+		expired := time.Now().After(entry.expires)
+		hostname := entry.hostname
+		if expired {
+			entry.pending = true
+		}
+		r.mu.Unlock()
+		if expired {
+			r.submit(key, ip)
+		}
+		return hostname, hostname != ""
+	}
+
+	entry := &addressResolverEntry{key: key, pending: true}
+	r.index[key] = r.lru.PushFront(entry)
+	r.evictLocked()
+	r.mu.Unlock()
+
+	r.submit(key, ip)
+	return "", false
+}
+
+func (r *cachedAddressResolver) resolve(key string, ip net.IP) {
+	names, err := net.LookupAddr(ip.String())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	el, ok := r.index[key]
+	if !ok {
+		return
+	}
+	entry := el.Value.(*addressResolverEntry)
+	entry.pending = false
+	entry.expires = time.Now().Add(addressResolverTTL)
+	if err == nil && len(names) > 0 {
+		entry.hostname = strings.TrimSuffix(names[0], ".")
+	}
+}
+
+// evictLocked drops the least recently used cache entry once the cache
+// exceeds addressResolverCacheSize. The caller must hold r.mu.
+func (r *cachedAddressResolver) evictLocked() {
+	if r.lru.Len() <= addressResolverCacheSize {
+		return
+	}
+	el := r.lru.Back()
+	if el == nil {
+		return
+	}
+	entry := el.Value.(*addressResolverEntry)
+	r.lru.Remove(el)
+	delete(r.index, entry.key)
+}
+
+func (r *cachedAddressResolver) ServiceName(port uint16, proto string) (string, bool) {
+	r.servicesOnce.Do(r.loadServices)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name, ok := r.services[servicesKey(port, proto)]
+	return name, ok
+}
+
+func (r *cachedAddressResolver) loadServices() {
+	r.services = make(map[string]string)
+
+	f, err := os.Open("/etc/services")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		name := fields[0]
+		portProto := strings.SplitN(fields[1], "/", 2)
+		if len(portProto) != 2 {
+			continue
+		}
+		port, err := strconv.ParseUint(portProto[0], 10, 16)
+		if err != nil {
+			continue
+		}
+		r.services[servicesKey(uint16(port), portProto[1])] = name
+	}
+}
+
+func servicesKey(port uint16, proto string) string {
+	return strconv.Itoa(int(port)) + "/" + proto
+}
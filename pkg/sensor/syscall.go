@@ -16,6 +16,7 @@ package sensor
 
 import (
 	"fmt"
+	"runtime"
 	"sync"
 	"sync/atomic"
 
@@ -26,10 +27,39 @@ import (
 	"github.com/golang/glog"
 )
 
+// SyscallABI identifies the calling convention a syscall was entered
+// through. The same numeric syscall ID means different things depending on
+// which entry path the caller used, so filters and consumers that care about
+// the actual syscall being made need to know the ABI along with the ID.
+type SyscallABI uint8
+
+const (
+	// ABI64 indicates the syscall was made through the native 64-bit
+	// entry path.
+	ABI64 SyscallABI = iota
+	// ABI32 indicates the syscall was made through the 32-bit compat
+	// entry path (e.g., int $0x80 or the compat SYSCALL/SYSENTER entry).
+	ABI32
+	// ABIX32 indicates the syscall was made through the x32 entry path,
+	// which uses the native 64-bit calling convention but a distinct
+	// syscall number space.
+	ABIX32
+)
+
+// x32SyscallBit is __X32_SYSCALL_BIT from the kernel. It is set in orig_ax
+// for syscalls made through the x32 entry path.
+const x32SyscallBit = 0x40000000
+
+// userCS32 is __USER32_CS from the kernel's x86_64 segment layout. It is
+// the code segment selector loaded into pt_regs.cs for tasks running in
+// 32-bit compat mode.
+const userCS32 = 0x23
+
 // SyscallEnterEventTypes defines the field types that can be used with filters
 // on syscall enter telemetry events.
 var SyscallEnterEventTypes = expression.FieldTypeMap{
 	"id":   expression.ValueTypeSignedInt64,
+	"abi":  expression.ValueTypeUnsignedInt8,
 	"arg0": expression.ValueTypeUnsignedInt64,
 	"arg1": expression.ValueTypeUnsignedInt64,
 	"arg2": expression.ValueTypeUnsignedInt64,
@@ -42,6 +72,7 @@ var SyscallEnterEventTypes = expression.FieldTypeMap{
 // on syscall exit telemetry events.
 var SyscallExitEventTypes = expression.FieldTypeMap{
 	"id":  expression.ValueTypeSignedInt64,
+	"abi": expression.ValueTypeUnsignedInt8,
 	"ret": expression.ValueTypeSignedInt64,
 }
 
@@ -53,7 +84,14 @@ type SyscallEnterTelemetryEvent struct {
 	TelemetryEventData
 
 	ID        int64
+	ABI       SyscallABI
 	Arguments [6]uint64
+
+	// Decoded holds the synthetic decoded fields (path_ptr, fd, flags_str,
+	// ...) for this syscall, as described by the SyscallTable passed to
+	// RegisterSyscallEnterEventFilter via WithSyscallTable. It is nil if
+	// no table was supplied or the syscall ID isn't in the table.
+	Decoded map[string]interface{}
 }
 
 // CommonTelemetryEventData returns the telemtry event data common to all
@@ -68,6 +106,7 @@ type SyscallExitTelemetryEvent struct {
 	TelemetryEventData
 
 	ID     int64
+	ABI    SyscallABI
 	Return int64
 }
 
@@ -77,16 +116,72 @@ func (e SyscallExitTelemetryEvent) CommonTelemetryEventData() TelemetryEventData
 	return e.TelemetryEventData
 }
 
+// argKeys names the kprobe fetcharg fields used on the dedicated
+// syscall-entry kprobe path (see syscallEnterArchSpecs).
 var argKeys = []string{"arg0", "arg1", "arg2", "arg3", "arg4", "arg5"}
 
-func (s *Subscription) handleSyscallTraceEnter(eventid uint64, sample *perf.Sample) {
-	var e SyscallEnterTelemetryEvent
-	if e.InitWithSample(s.sensor, sample) {
-		e.ID, _ = sample.GetSignedInt64("id")
-		for i := 0; i < 6; i++ {
-			e.Arguments[i], _ = sample.GetUnsignedInt64(argKeys[i])
+// tracepointArgKeys names the fields of the generic
+// raw_syscalls/sys_enter (or syscalls/sys_enter) tracepoint used as a
+// fallback on architectures with no syscallEnterKprobeSpec. Unlike the
+// kprobe fetcharg path, which synthesizes arg0..arg5 from named pt_regs
+// offsets, the tracepoint's own format exposes the arguments as an "args"
+// array, and has no "cs"-equivalent field at all.
+var tracepointArgKeys = []string{"args[0]", "args[1]", "args[2]", "args[3]", "args[4]", "args[5]"}
+
+// syscallABIFromEnter derives the SyscallABI for a syscall enter event from
+// the raw syscall number and the %cs selector captured off of pt_regs. The
+// x32 ABI is identified by __X32_SYSCALL_BIT being set in the syscall
+// number; the 32-bit compat ABI is identified by the task running with
+// __USER32_CS loaded, which is only true for the compat entry path.
+func syscallABIFromEnter(id int64, cs uint64) SyscallABI {
+	if id&x32SyscallBit != 0 {
+		return ABIX32
+	}
+	if cs&0xffff == userCS32 {
+		return ABI32
+	}
+	return ABI64
+}
+
+// syscallEnterArgsFromSample reads the syscall ID, ABI, and argument
+// registers off of a syscall enter sample. useTracepoint selects which
+// field layout to read: false for the dedicated kprobe's fetchargs
+// (arg0..arg5, cs), true for the generic sys_enter tracepoint's own format
+// (an args[6] array and no cs field). Reusing the kprobe field names on the
+// tracepoint fallback (or vice versa) would silently read zero for every
+// field, since the two paths don't share a format.
+func syscallEnterArgsFromSample(sample *perf.Sample, useTracepoint bool) (id int64, abi SyscallABI, args [6]uint64) {
+	id, _ = sample.GetSignedInt64("id")
+
+	var cs uint64
+	keys := argKeys
+	if useTracepoint {
+		keys = tracepointArgKeys
+	} else {
+		cs, _ = sample.GetUnsignedInt64("cs")
+	}
+	for i := 0; i < 6; i++ {
+		args[i], _ = sample.GetUnsignedInt64(keys[i])
+	}
+
+	// On the tracepoint path, cs is always 0, so only the x32 ABI
+	// (identifiable from id alone) is distinguished; telling native
+	// 64-bit apart from 32-bit compat requires the cs register, which
+	// only the kprobe fetchargs path has.
+	abi = syscallABIFromEnter(id, cs)
+	return
+}
+
+// syscallEnterHandler returns a syscall enter handler for use with
+// registerSyscallEnterKprobe, reading the sample's fields according to
+// useTracepoint (see syscallEnterArgsFromSample).
+func (s *Subscription) syscallEnterHandler(useTracepoint bool) func(uint64, *perf.Sample) {
+	return func(eventid uint64, sample *perf.Sample) {
+		var e SyscallEnterTelemetryEvent
+		if e.InitWithSample(s.sensor, sample) {
+			e.ID, e.ABI, e.Arguments = syscallEnterArgsFromSample(sample, useTracepoint)
+			s.DispatchEvent(eventid, e, nil)
 		}
-		s.DispatchEvent(eventid, e, nil)
 	}
 }
 
@@ -94,26 +189,93 @@ func (s *Subscription) handleSysExit(eventid uint64, sample *perf.Sample) {
 	var e SyscallExitTelemetryEvent
 	if e.InitWithSample(s.sensor, sample) {
 		e.ID, _ = sample.GetSignedInt64("id")
+		// raw_syscalls/sys_exit only reports the syscall number, so
+		// only the x32 ABI (identifiable from the ID alone) can be
+		// distinguished here; telling native 64-bit apart from 32-bit
+		// compat requires correlating back to the matching enter
+		// event's pt_regs.
+		if e.ID&x32SyscallBit != 0 {
+			e.ABI = ABIX32
+		}
 		e.Return, _ = sample.GetSignedInt64("ret")
 		s.DispatchEvent(eventid, e, nil)
 	}
 }
 
-const (
-	syscallNewEnterKprobeAddress string = "syscall_trace_enter_phase1"
-	syscallOldEnterKprobeAddress string = "syscall_trace_enter"
+// syscallEnterKprobeSpec describes how to register the syscall enter kprobe
+// on a given architecture: which symbol(s) to try, in order, and the
+// fetchargs string to use with whichever one is available. A nil Symbols
+// means no kprobe is available for the architecture; RegisterSyscallEnterEventFilter
+// then falls back to the generic raw_syscalls/sys_enter tracepoint, which
+// works everywhere but only fires after seccomp has already run.
+type syscallEnterKprobeSpec struct {
+	Symbols        []string
+	Fetchargs      string
+	FetchargsNoABI string
+}
 
+const (
 	// These offsets index into the x86_64 version of struct pt_regs
 	// in the kernel. This is a stable structure.
-	syscallEnterKprobeFetchargs string = "id=+120(%di):s64 " + // orig_ax
+	x86_64SyscallEnterKprobeFetchargs string = "id=+120(%di):s64 " + // orig_ax
 		"arg0=+112(%di):u64 " + // di
 		"arg1=+104(%di):u64 " + // si
 		"arg2=+96(%di):u64 " + // dx
 		"arg3=+56(%di):u64 " + // r10
 		"arg4=+72(%di):u64 " + // r8
-		"arg5=+64(%di):u64" // r9
+		"arg5=+64(%di):u64 " + // r9
+		"cs=+136(%di):u64" // cs
+
+	// x86_64SyscallEnterKprobeFetchargsNoABI is
+	// x86_64SyscallEnterKprobeFetchargs without the "cs" fetcharg, for
+	// consumers that opt out of ABI tagging via WithoutSyscallABI.
+	x86_64SyscallEnterKprobeFetchargsNoABI string = "id=+120(%di):s64 " +
+		"arg0=+112(%di):u64 " +
+		"arg1=+104(%di):u64 " +
+		"arg2=+96(%di):u64 " +
+		"arg3=+56(%di):u64 " +
+		"arg4=+72(%di):u64 " +
+		"arg5=+64(%di):u64"
+
+	// arm64 struct pt_regs stores the general purpose registers in the
+	// regs[] array; x0..x5 (the argument registers) are regs[0..5] and
+	// the syscall number that el0_svc_common/el0_svc_handler dispatch on
+	// is regs[8] (passed through from the w8 instruction operand, per
+	// the AArch64 syscall calling convention). There is no separate
+	// compat-mode register snapshot equivalent to x86_64's %cs, so ABI
+	// tagging is not attempted on this path.
+	arm64SyscallEnterKprobeFetchargs string = "id=+64(%x0):s64 " + // regs[8]
+		"arg0=+0(%x0):u64 " + // regs[0]
+		"arg1=+8(%x0):u64 " + // regs[1]
+		"arg2=+16(%x0):u64 " + // regs[2]
+		"arg3=+24(%x0):u64 " + // regs[3]
+		"arg4=+32(%x0):u64 " + // regs[4]
+		"arg5=+40(%x0):u64" // regs[5]
 )
 
+// syscallEnterArchSpecs maps runtime.GOARCH to the kprobe symbols and
+// fetchargs used to trace syscall entry on that architecture.
+var syscallEnterArchSpecs = map[string]syscallEnterKprobeSpec{
+	"amd64": {
+		Symbols:        []string{"syscall_trace_enter_phase1", "syscall_trace_enter"},
+		Fetchargs:      x86_64SyscallEnterKprobeFetchargs,
+		FetchargsNoABI: x86_64SyscallEnterKprobeFetchargsNoABI,
+	},
+	"arm64": {
+		Symbols:        []string{"el0_svc_common", "el0_svc_handler"},
+		Fetchargs:      arm64SyscallEnterKprobeFetchargs,
+		FetchargsNoABI: arm64SyscallEnterKprobeFetchargs,
+	},
+}
+
+// syscallEnterSpecForArch returns the syscallEnterKprobeSpec to use for
+// goarch (normally runtime.GOARCH), falling back to the tracepoint-only
+// generic spec (zero value, no Symbols) for architectures without a
+// dedicated kprobe spec.
+func syscallEnterSpecForArch(goarch string) syscallEnterKprobeSpec {
+	return syscallEnterArchSpecs[goarch]
+}
+
 var (
 	syscallOnce      sync.Once
 	syscallEnterName string
@@ -180,13 +342,107 @@ func (s *Subscription) registerLocalDummySyscallEvent() bool {
 	return true
 }
 
+type syscallEnterConfig struct {
+	noABI bool
+	table *SyscallTable
+}
+
+// SyscallEnterOption is used to modify the default behavior of
+// RegisterSyscallEnterEventFilter.
+type SyscallEnterOption func(*syscallEnterConfig)
+
+// WithoutSyscallABI restores the pre-ABI-tagging behavior of
+// RegisterSyscallEnterEventFilter for consumers that do not need the ABI
+// field and want to avoid the cost of fetching the extra register. It has
+// no effect on architectures whose syscallEnterKprobeSpec has no separate
+// no-ABI fetchargs.
+func WithoutSyscallABI() SyscallEnterOption {
+	return func(c *syscallEnterConfig) {
+		c.noABI = true
+	}
+}
+
+// WithSyscallTable has RegisterSyscallEnterEventFilter decode each event's
+// raw argument registers into named, typed fields (SyscallEnterTelemetryEvent.Decoded)
+// using table. See SyscallEnterEventTypesForTable for widening a
+// subscription's filter field types to match.
+func WithSyscallTable(table *SyscallTable) SyscallEnterOption {
+	return func(c *syscallEnterConfig) {
+		c.table = table
+	}
+}
+
 // RegisterSyscallEnterEventFilter registers a syscall enter event filter with
 // a subscription.
 func (s *Subscription) RegisterSyscallEnterEventFilter(
 	filter *expression.Expression,
+	options ...SyscallEnterOption,
+) {
+	var config syscallEnterConfig
+	for _, option := range options {
+		option(&config)
+	}
+
+	handlerFactory := s.syscallEnterHandler
+	if config.table != nil {
+		handlerFactory = func(useTracepoint bool) func(uint64, *perf.Sample) {
+			return s.syscallTraceEnterHandlerWithTable(config.table, useTracepoint)
+		}
+	}
+	s.registerSyscallEnterKprobe(config.noABI, handlerFactory, filter)
+}
+
+// syscallTraceEnterHandlerWithTable returns a syscall enter handler that
+// additionally decodes each event's arguments using table. useTracepoint is
+// forwarded to syscallEnterArgsFromSample; see registerSyscallEnterKprobe.
+func (s *Subscription) syscallTraceEnterHandlerWithTable(table *SyscallTable, useTracepoint bool) func(uint64, *perf.Sample) {
+	return func(eventid uint64, sample *perf.Sample) {
+		var e SyscallEnterTelemetryEvent
+		if !e.InitWithSample(s.sensor, sample) {
+			return
+		}
+		e.ID, e.ABI, e.Arguments = syscallEnterArgsFromSample(sample, useTracepoint)
+		if spec, ok := table.Lookup(e.ID); ok {
+			e.Decoded = decodedSyscallFields(spec, e.Arguments)
+		}
+		s.DispatchEvent(eventid, e, nil)
+	}
+}
+
+// registerSyscallEnterKprobe installs the syscall enter kprobe used by both
+// RegisterSyscallEnterEventFilter and RegisterSyscallEventFilter, handling
+// the dummy-event dance needed to coax the kernel into making the calls that
+// cause the kprobe to fire. On architectures with no known kprobe spec (see
+// syscallEnterArchSpecs), it instead registers a handler directly against
+// the generic raw_syscalls/sys_enter tracepoint, which works on any
+// architecture but only fires after seccomp has already run.
+//
+// handlerFactory builds the handler to register, given whether the
+// tracepoint fallback is being used; the kprobe fetchargs path and the
+// tracepoint path expose the syscall ID/ABI/arguments under different
+// field names (see syscallEnterArgsFromSample), so the handler can't be
+// built once and reused across both.
+//
+// The event struct shape (SyscallEnterEventTypes, SyscallEnterTelemetryEvent)
+// is the same regardless of which path is used.
+func (s *Subscription) registerSyscallEnterKprobe(
+	noABI bool,
+	handlerFactory func(useTracepoint bool) func(uint64, *perf.Sample),
+	filter *expression.Expression,
 ) {
 	syscallOnce.Do(s.initSyscallNames)
 
+	spec := syscallEnterSpecForArch(runtime.GOARCH)
+	if len(spec.Symbols) == 0 {
+		s.registerTracepoint(syscallEnterName, handlerFactory(true), filter)
+		return
+	}
+
+	fetchargs := spec.Fetchargs
+	if noABI && spec.FetchargsNoABI != "" {
+		fetchargs = spec.FetchargsNoABI
+	}
+
 	// Create the dummy syscall event. This event is needed to put
 	// the kernel into a mode where it'll make the function calls
 	// needed to make the kprobe we'll add fire. Add the tracepoint,
@@ -213,20 +469,28 @@ func (s *Subscription) RegisterSyscallEnterEventFilter(
 		}
 	}
 	if result {
-		// There are two possible kprobes. Newer kernels (>= 4.1) have
-		// refactored syscall entry code, so syscall_trace_enter_phase1
-		// is the right one, but for older kernels syscall_trace_enter
-		// is the right one. Both have the same signature, so the
-		// fetchargs doesn't have to change. Try the new probe first,
-		// because the old probe will also set in the newer kernels,
-		// but it won't fire.
-		kprobeSymbol := syscallNewEnterKprobeAddress
-		if !s.sensor.IsKernelSymbolAvailable(kprobeSymbol) {
-			kprobeSymbol = syscallOldEnterKprobeAddress
+		// Try each candidate symbol in order and use the first one
+		// available on the running kernel. For x86_64, newer kernels
+		// (>= 4.1) have refactored syscall entry code, so
+		// syscall_trace_enter_phase1 is the right one, but for older
+		// kernels syscall_trace_enter is the right one; both have the
+		// same signature, so the fetchargs doesn't have to change.
+		// Try the new probe first, because the old probe will also
+		// exist on newer kernels, but it won't fire.
+		//
+		// Declare both candidates up front so the first kallsyms scan
+		// resolves them together instead of one rescan per candidate.
+		s.sensor.RegisterRequiredSymbols(spec.Symbols)
+		kprobeSymbol := spec.Symbols[0]
+		for _, symbol := range spec.Symbols {
+			if s.sensor.IsKernelSymbolAvailable(symbol) {
+				kprobeSymbol = symbol
+				break
+			}
 		}
 
 		es, err := s.registerKprobe(kprobeSymbol, false,
-			syscallEnterKprobeFetchargs, s.handleSyscallTraceEnter,
+			fetchargs, handlerFactory(false),
 			filter, false)
 		if err != nil {
 			if unregister != nil {
@@ -247,3 +511,281 @@ func (s *Subscription) RegisterSyscallExitEventFilter(
 
 	s.registerTracepoint(syscallExitName, s.handleSysExit, filter)
 }
+
+// SyscallEventTypes defines the field types that can be used with filters on
+// correlated syscall telemetry events. It is the union of the enter and exit
+// field maps, since a correlated event carries both.
+var SyscallEventTypes = expression.FieldTypeMap{
+	"id":   expression.ValueTypeSignedInt64,
+	"abi":  expression.ValueTypeUnsignedInt8,
+	"arg0": expression.ValueTypeUnsignedInt64,
+	"arg1": expression.ValueTypeUnsignedInt64,
+	"arg2": expression.ValueTypeUnsignedInt64,
+	"arg3": expression.ValueTypeUnsignedInt64,
+	"arg4": expression.ValueTypeUnsignedInt64,
+	"arg5": expression.ValueTypeUnsignedInt64,
+	"ret":  expression.ValueTypeSignedInt64,
+}
+
+// SyscallTelemetryEvent is a telemetry event that correlates a syscall enter
+// event with its matching exit event, generated on exit once the two have
+// been joined.
+type SyscallTelemetryEvent struct {
+	TelemetryEventData
+
+	ID            int64
+	ABI           SyscallABI
+	Arguments     [6]uint64
+	Return        int64
+	DurationNanos int64
+}
+
+// CommonTelemetryEventData returns the telemtry event data common to all
+// telemetry events for a chargen telemetry event.
+func (e SyscallTelemetryEvent) CommonTelemetryEventData() TelemetryEventData {
+	return e.TelemetryEventData
+}
+
+// pendingSyscallKey identifies the task a pending syscall enter frame
+// belongs to. CPU is included because a thread can be in the middle of a
+// syscall recorded on one CPU and then be migrated, but the enter and exit
+// records for the same syscall are always observed on the same CPU.
+type pendingSyscallKey struct {
+	cpu uint32
+	pid uint32
+	tid uint32
+}
+
+// pendingSyscallFrame is a syscall enter event awaiting its matching exit.
+type pendingSyscallFrame struct {
+	data      TelemetryEventData
+	id        int64
+	abi       SyscallABI
+	arguments [6]uint64
+	enterTime uint64
+}
+
+// syscallFrameStack is a per-task stack of pending syscall enter frames.
+// It is a stack, not a single pending frame, because a thread can re-enter
+// the syscall path before its outermost syscall has exited (signal handlers
+// interrupting a blocking syscall, seccomp retry, etc.).
+type syscallFrameStack struct {
+	mu     sync.Mutex
+	frames []pendingSyscallFrame
+}
+
+func (fs *syscallFrameStack) push(f pendingSyscallFrame) {
+	fs.mu.Lock()
+	fs.frames = append(fs.frames, f)
+	fs.mu.Unlock()
+}
+
+// pop removes and returns the pending frame matching id, along with whether
+// any frames had to be discarded to find it (which indicates a missed exit
+// event further down the stack).
+func (fs *syscallFrameStack) pop(id int64) (frame pendingSyscallFrame, ok bool, discarded int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for i := len(fs.frames) - 1; i >= 0; i-- {
+		if fs.frames[i].id == id {
+			frame = fs.frames[i]
+			discarded = len(fs.frames) - 1 - i
+			fs.frames = fs.frames[:i]
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+// pendingSyscallTables holds the per-task correlation stacks for each
+// Subscription, keyed off the Subscription itself the same way
+// networkFlowTables is in network_flow.go. Each Subscription registers its
+// own syscall enter/exit filters independently, so two subscriptions tracing
+// the same thread must not share (and corrupt) each other's pending frames.
+var (
+	pendingSyscallTablesMu sync.Mutex
+	pendingSyscallTables   = map[*Subscription]*sync.Map{} // map[pendingSyscallKey]*syscallFrameStack
+
+	syscallFrameMismatchLogs uint64
+)
+
+func pendingSyscallsFor(s *Subscription) *sync.Map {
+	pendingSyscallTablesMu.Lock()
+	defer pendingSyscallTablesMu.Unlock()
+	m, ok := pendingSyscallTables[s]
+	if !ok {
+		m = &sync.Map{}
+		pendingSyscallTables[s] = m
+	}
+	return m
+}
+
+// deletePendingSyscallTable drops s's correlation table, called once its
+// exit probe is torn down (see RegisterSyscallEventFilter) so that a
+// subscription's entry in pendingSyscallTables doesn't outlive the
+// subscription itself.
+func deletePendingSyscallTable(s *Subscription) {
+	pendingSyscallTablesMu.Lock()
+	delete(pendingSyscallTables, s)
+	pendingSyscallTablesMu.Unlock()
+}
+
+// syscallEventFilters holds the per-subscription filter registered by
+// RegisterSyscallEventFilter, keyed off the Subscription the same way
+// pendingSyscallTables is. It is evaluated in Go, in
+// handleCorrelatedSyscallExit, against the fully-correlated
+// SyscallTelemetryEvent, not handed to the sys_exit tracepoint: that probe
+// only carries "id" and "ret", not the enter-time arg0..arg5 a filter may
+// also reference.
+var (
+	syscallEventFiltersMu sync.Mutex
+	syscallEventFilters   = map[*Subscription]*expression.Expression{}
+)
+
+func setSyscallEventFilter(s *Subscription, filter *expression.Expression) {
+	syscallEventFiltersMu.Lock()
+	syscallEventFilters[s] = filter
+	syscallEventFiltersMu.Unlock()
+}
+
+func syscallEventFilterFor(s *Subscription) *expression.Expression {
+	syscallEventFiltersMu.Lock()
+	defer syscallEventFiltersMu.Unlock()
+	return syscallEventFilters[s]
+}
+
+// deleteSyscallEventFilter drops s's registered filter, called once its exit
+// probe is torn down (see RegisterSyscallEventFilter) so that a
+// subscription's entry in syscallEventFilters doesn't outlive the
+// subscription itself.
+func deleteSyscallEventFilter(s *Subscription) {
+	syscallEventFiltersMu.Lock()
+	delete(syscallEventFilters, s)
+	syscallEventFiltersMu.Unlock()
+}
+
+// logThrottledFrameMismatch logs a syscall correlation mismatch at a reduced
+// rate, since a busy sensor can generate a very large number of these if a
+// filter or a kernel quirk is dropping exit events; logging each one
+// individually would flood the log.
+func logThrottledFrameMismatch(format string, args ...interface{}) {
+	if n := atomic.AddUint64(&syscallFrameMismatchLogs, 1); n == 1 || n%1000 == 0 {
+		glog.V(2).Infof(format, args...)
+	}
+}
+
+func syscallFrameStackFor(s *Subscription, key pendingSyscallKey) *syscallFrameStack {
+	pending := pendingSyscallsFor(s)
+	if v, ok := pending.Load(key); ok {
+		return v.(*syscallFrameStack)
+	}
+	fs := &syscallFrameStack{}
+	v, _ := pending.LoadOrStore(key, fs)
+	return v.(*syscallFrameStack)
+}
+
+// pendingSyscallEnterHandler returns a syscall enter handler that pushes a
+// pending frame for later correlation with the matching exit. useTracepoint
+// is forwarded to syscallEnterArgsFromSample; see registerSyscallEnterKprobe.
+func (s *Subscription) pendingSyscallEnterHandler(useTracepoint bool) func(uint64, *perf.Sample) {
+	return func(eventid uint64, sample *perf.Sample) {
+		var e SyscallEnterTelemetryEvent
+		if !e.InitWithSample(s.sensor, sample) {
+			return
+		}
+		e.ID, e.ABI, e.Arguments = syscallEnterArgsFromSample(sample, useTracepoint)
+
+		frame := pendingSyscallFrame{
+			data:      e.TelemetryEventData,
+			id:        e.ID,
+			abi:       e.ABI,
+			arguments: e.Arguments,
+			enterTime: sample.Time,
+		}
+
+		key := pendingSyscallKey{cpu: sample.CPU, pid: sample.Pid, tid: sample.Tid}
+		syscallFrameStackFor(s, key).push(frame)
+	}
+}
+
+func (s *Subscription) handleCorrelatedSyscallExit(eventid uint64, sample *perf.Sample) {
+	id, _ := sample.GetSignedInt64("id")
+	key := pendingSyscallKey{cpu: sample.CPU, pid: sample.Pid, tid: sample.Tid}
+
+	frame, ok, discarded := syscallFrameStackFor(s, key).pop(id)
+	if !ok {
+		logThrottledFrameMismatch(
+			"no pending syscall enter frame for exit of id %d on pid %d tid %d",
+			id, key.pid, key.tid)
+		return
+	}
+	if discarded > 0 {
+		logThrottledFrameMismatch(
+			"discarded %d unmatched syscall enter frame(s) for pid %d tid %d",
+			discarded, key.pid, key.tid)
+	}
+
+	var e SyscallTelemetryEvent
+	e.TelemetryEventData = frame.data
+	e.ID = frame.id
+	e.ABI = frame.abi
+	e.Arguments = frame.arguments
+	e.Return, _ = sample.GetSignedInt64("ret")
+	e.DurationNanos = int64(sample.Time - frame.enterTime)
+
+	if filter := syscallEventFilterFor(s); filter != nil {
+		matched, err := filter.Evaluate(syscallFieldValues(e))
+		if err != nil || !matched {
+			return
+		}
+	}
+
+	s.DispatchEvent(eventid, e, nil)
+}
+
+// syscallFieldValues builds the field values a SyscallEventTypes filter is
+// evaluated against from a fully-correlated SyscallTelemetryEvent, mirroring
+// the field names declared in SyscallEventTypes.
+func syscallFieldValues(e SyscallTelemetryEvent) expression.FieldValueMap {
+	return expression.FieldValueMap{
+		"id":   e.ID,
+		"abi":  uint8(e.ABI),
+		"arg0": e.Arguments[0],
+		"arg1": e.Arguments[1],
+		"arg2": e.Arguments[2],
+		"arg3": e.Arguments[3],
+		"arg4": e.Arguments[4],
+		"arg5": e.Arguments[5],
+		"ret":  e.Return,
+	}
+}
+
+// RegisterSyscallEventFilter registers a correlated syscall event filter with
+// a subscription. Unlike RegisterSyscallEnterEventFilter and
+// RegisterSyscallExitEventFilter, which each report one half of a syscall
+// independently, this joins a syscall's enter and exit records into a single
+// SyscallTelemetryEvent delivered when the syscall returns, so a filter can
+// reference enter-only fields (arg0..arg5) and exit-only fields (ret) at the
+// same time, e.g. "id == execve && ret < 0".
+//
+// filter is not handed to the sys_exit tracepoint: that probe's raw sample
+// only carries "id" and "ret", not the enter-time arguments a filter
+// referencing arg0..arg5 needs. It is instead evaluated in Go, in
+// handleCorrelatedSyscallExit, once the enter and exit records have been
+// joined into a SyscallTelemetryEvent.
+func (s *Subscription) RegisterSyscallEventFilter(
+	filter *expression.Expression,
+) {
+	setSyscallEventFilter(s, filter)
+
+	s.registerSyscallEnterKprobe(false, s.pendingSyscallEnterHandler, nil)
+	es, err := s.registerTracepoint(syscallExitName, s.handleCorrelatedSyscallExit, nil)
+	if err == nil {
+		es.unregister = func(*eventSink) {
+			deletePendingSyscallTable(s)
+			deleteSyscallEventFilter(s)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensor
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/capsule8/capsule8/pkg/expression"
+)
+
+// ArgType describes the semantic meaning of a single syscall argument, so
+// that consumers don't each have to re-derive which of arg0..arg5 is a file
+// descriptor, a path, or a flags bitmask for a given syscall.
+type ArgType int
+
+// The argument types a SyscallTable can describe.
+const (
+	// ArgNone means the argument is unused by this syscall.
+	ArgNone ArgType = iota
+	// ArgInt is a plain signed integer.
+	ArgInt
+	// ArgUint is a plain unsigned integer.
+	ArgUint
+	// ArgFd is an open file descriptor number.
+	ArgFd
+	// ArgPath is a pointer to a NUL-terminated pathname string.
+	ArgPath
+	// ArgBuffer is a pointer to a buffer whose length is given by another
+	// argument, identified by LenArgIndex.
+	ArgBuffer
+	// ArgSockAddr is a pointer to a struct sockaddr.
+	ArgSockAddr
+	// ArgFlags is a bitmask whose individual bits are named in FlagBits.
+	ArgFlags
+	// ArgSignal is a signal number.
+	ArgSignal
+	// ArgMode is a file mode/permission bitmask (as used by open, chmod).
+	ArgMode
+)
+
+// ArgSpec describes a single argument of a syscall.
+type ArgSpec struct {
+	// Name is the argument's name, used as the decoded field name.
+	Name string
+	Type ArgType
+	// LenArgIndex is the index (0..5) of the argument giving this
+	// argument's length, when Type is ArgBuffer.
+	LenArgIndex int
+	// FlagBits names the individual bits of an ArgFlags argument, for
+	// rendering a human-readable flags string.
+	FlagBits map[uint64]string
+}
+
+// SyscallSpec describes the name and arguments of a single syscall. It does
+// not describe the syscall's return value.
+type SyscallSpec struct {
+	Name string
+	Args [6]ArgSpec
+}
+
+// SyscallTable maps syscall numbers to their argument semantics. The zero
+// value is not usable; create one with NewSyscallTable.
+type SyscallTable struct {
+	mu       sync.RWMutex
+	syscalls map[int64]SyscallSpec
+}
+
+// NewSyscallTable creates an empty SyscallTable.
+func NewSyscallTable() *SyscallTable {
+	return &SyscallTable{
+		syscalls: make(map[int64]SyscallSpec),
+	}
+}
+
+// Register adds or replaces the SyscallSpec for the given syscall number.
+// This is the extension point out-of-tree consumers use to describe
+// syscalls that aren't in DefaultX86_64SyscallTable, or to override entries
+// in it.
+func (t *SyscallTable) Register(id int64, spec SyscallSpec) {
+	t.mu.Lock()
+	t.syscalls[id] = spec
+	t.mu.Unlock()
+}
+
+// Lookup returns the SyscallSpec registered for id, if any.
+func (t *SyscallTable) Lookup(id int64) (SyscallSpec, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	spec, ok := t.syscalls[id]
+	return spec, ok
+}
+
+// DefaultX86_64SyscallTable returns a SyscallTable pre-populated with the
+// argument semantics of the x86_64 syscalls most commonly referenced by
+// telemetry filters. It is not exhaustive; out-of-tree consumers can extend
+// it (or a copy of it) with Register.
+func DefaultX86_64SyscallTable() *SyscallTable {
+	t := NewSyscallTable()
+	for id, spec := range x86_64Syscalls {
+		t.Register(id, spec)
+	}
+	return t
+}
+
+// x86_64Syscalls is the generated seed data for DefaultX86_64SyscallTable,
+// keyed by native x86_64 syscall number.
+var x86_64Syscalls = map[int64]SyscallSpec{
+	0: {Name: "read", Args: [6]ArgSpec{
+		{Name: "fd", Type: ArgFd},
+		{Name: "buf", Type: ArgBuffer, LenArgIndex: 2},
+		{Name: "count", Type: ArgUint},
+	}},
+	1: {Name: "write", Args: [6]ArgSpec{
+		{Name: "fd", Type: ArgFd},
+		{Name: "buf", Type: ArgBuffer, LenArgIndex: 2},
+		{Name: "count", Type: ArgUint},
+	}},
+	2: {Name: "open", Args: [6]ArgSpec{
+		{Name: "path", Type: ArgPath},
+		{Name: "flags", Type: ArgFlags, FlagBits: openFlagBits},
+		{Name: "mode", Type: ArgMode},
+	}},
+	3: {Name: "close", Args: [6]ArgSpec{
+		{Name: "fd", Type: ArgFd},
+	}},
+	41: {Name: "socket", Args: [6]ArgSpec{
+		{Name: "family", Type: ArgInt},
+		{Name: "type", Type: ArgInt},
+		{Name: "protocol", Type: ArgInt},
+	}},
+	42: {Name: "connect", Args: [6]ArgSpec{
+		{Name: "fd", Type: ArgFd},
+		{Name: "addr", Type: ArgSockAddr},
+		{Name: "addrlen", Type: ArgUint},
+	}},
+	49: {Name: "bind", Args: [6]ArgSpec{
+		{Name: "fd", Type: ArgFd},
+		{Name: "addr", Type: ArgSockAddr},
+		{Name: "addrlen", Type: ArgUint},
+	}},
+	56: {Name: "clone", Args: [6]ArgSpec{
+		{Name: "flags", Type: ArgFlags, FlagBits: cloneFlagBits},
+	}},
+	57:  {Name: "fork"},
+	59:  {Name: "execve", Args: [6]ArgSpec{{Name: "path", Type: ArgPath}}},
+	60:  {Name: "exit", Args: [6]ArgSpec{{Name: "status", Type: ArgInt}}},
+	62:  {Name: "kill", Args: [6]ArgSpec{{Name: "pid", Type: ArgInt}, {Name: "sig", Type: ArgSignal}}},
+	257: {Name: "openat", Args: [6]ArgSpec{
+		{Name: "dfd", Type: ArgFd},
+		{Name: "path", Type: ArgPath},
+		{Name: "flags", Type: ArgFlags, FlagBits: openFlagBits},
+		{Name: "mode", Type: ArgMode},
+	}},
+}
+
+var openFlagBits = map[uint64]string{
+	0x0001: "O_WRONLY",
+	0x0002: "O_RDWR",
+	0x0040: "O_CREAT",
+	0x0080: "O_EXCL",
+	0x0200: "O_TRUNC",
+	0x0400: "O_APPEND",
+	0x0800: "O_NONBLOCK",
+}
+
+var cloneFlagBits = map[uint64]string{
+	0x00000100: "CLONE_VM",
+	0x00000200: "CLONE_FS",
+	0x00000400: "CLONE_FILES",
+	0x00010000: "CLONE_THREAD",
+}
+
+// decodeFlags renders value as a "|"-joined list of the FlagBits names whose
+// bits are set, in ascending bit order, for use in a filter's flags_str field.
+func decodeFlags(value uint64, bits map[uint64]string) string {
+	keys := make([]uint64, 0, len(bits))
+	for bit := range bits {
+		keys = append(keys, bit)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	s := ""
+	for _, bit := range keys {
+		if value&bit == bit {
+			if s != "" {
+				s += "|"
+			}
+			s += bits[bit]
+		}
+	}
+	return s
+}
+
+// decodedSyscallFields computes the synthetic decoded fields (path_ptr, fd,
+// flags_str, ...) for a syscall enter event, given the table entry for its
+// ID and its raw argument registers. The single generic syscall enter kprobe
+// only has access to the raw argument registers, not tracee memory, so
+// ArgPath cannot be resolved to the actual pathname string here; resolving
+// it requires a syscall-specific kprobe fetcharg (e.g. a ":string" fetcharg
+// on getname_flags/__do_sys_openat) installed per syscall ID, which this
+// register-only decoding does not do. ArgPath is therefore decoded as
+// "<name>_ptr", the raw pointer value, so that filters and consumers are not
+// misled into treating it as a resolved path.
+func decodedSyscallFields(spec SyscallSpec, args [6]uint64) map[string]interface{} {
+	fields := make(map[string]interface{}, len(spec.Args))
+	for i, arg := range spec.Args {
+		switch arg.Type {
+		case ArgNone:
+			continue
+		case ArgFd, ArgUint, ArgMode, ArgSignal:
+			fields[arg.Name] = args[i]
+		case ArgInt:
+			fields[arg.Name] = int64(args[i])
+		case ArgPath:
+			fields[arg.Name+"_ptr"] = args[i]
+		case ArgSockAddr, ArgBuffer:
+			fields[arg.Name] = fmt.Sprintf("0x%x", args[i])
+		case ArgFlags:
+			fields[arg.Name+"_str"] = decodeFlags(args[i], arg.FlagBits)
+			fields[arg.Name] = args[i]
+		}
+	}
+	return fields
+}
+
+// SyscallEnterEventTypesForTable widens SyscallEnterEventTypes with the
+// synthetic decoded fields (path_ptr, fd, flags_str, ...) described by every
+// syscall registered in table, regardless of which syscall IDs a filter
+// mentions. These are the field types of SyscallEnterTelemetryEvent.Decoded.
+// RegisterSyscallEnterEventFilter hands its filter to the syscall enter
+// probe, whose samples carry only id, arg0..arg5 and cs, so that filter does
+// not evaluate the decoded fields.
+func SyscallEnterEventTypesForTable(table *SyscallTable) expression.FieldTypeMap {
+	types := make(expression.FieldTypeMap, len(SyscallEnterEventTypes))
+	for k, v := range SyscallEnterEventTypes {
+		types[k] = v
+	}
+
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	for _, spec := range table.syscalls {
+		for _, arg := range spec.Args {
+			switch arg.Type {
+			case ArgNone:
+				continue
+			case ArgFd, ArgUint, ArgMode, ArgSignal:
+				types[arg.Name] = expression.ValueTypeUnsignedInt64
+			case ArgInt:
+				types[arg.Name] = expression.ValueTypeSignedInt64
+			case ArgPath:
+				types[arg.Name+"_ptr"] = expression.ValueTypeUnsignedInt64
+			case ArgSockAddr, ArgBuffer:
+				types[arg.Name] = expression.ValueTypeString
+			case ArgFlags:
+				types[arg.Name] = expression.ValueTypeUnsignedInt64
+				types[arg.Name+"_str"] = expression.ValueTypeString
+			}
+		}
+	}
+	return types
+}
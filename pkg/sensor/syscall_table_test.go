@@ -0,0 +1,164 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensor
+
+import "testing"
+
+// TestDecodeFlags verifies that decodeFlags renders every set bit of a
+// multi-bit value as a "|"-joined list of its names, and that unset or
+// unnamed bits contribute nothing.
+func TestDecodeFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		value uint64
+		bits  map[uint64]string
+		want  string
+	}{
+		{
+			name:  "no bits set",
+			value: 0,
+			bits:  openFlagBits,
+			want:  "",
+		},
+		{
+			name:  "single bit",
+			value: 0x0040,
+			bits:  openFlagBits,
+			want:  "O_CREAT",
+		},
+		{
+			name:  "multiple bits",
+			value: 0x0040 | 0x0200,
+			bits:  openFlagBits,
+			want:  "O_CREAT|O_TRUNC",
+		},
+		{
+			name:  "unnamed bit is ignored",
+			value: 0x1000,
+			bits:  openFlagBits,
+			want:  "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeFlags(tt.value, tt.bits)
+			if got != tt.want {
+				t.Fatalf("decodeFlags(%#x) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSyscallTableRegisterLookup verifies that Register makes a spec
+// retrievable by id, that Lookup on an unregistered id reports a miss
+// rather than a zero-valued SyscallSpec, and that a second Register call
+// replaces the first rather than merging with it.
+func TestSyscallTableRegisterLookup(t *testing.T) {
+	table := NewSyscallTable()
+
+	if _, ok := table.Lookup(999); ok {
+		t.Fatalf("Lookup of an unregistered id reported a hit")
+	}
+
+	spec := SyscallSpec{Name: "read", Args: [6]ArgSpec{{Name: "fd", Type: ArgFd}}}
+	table.Register(0, spec)
+
+	got, ok := table.Lookup(0)
+	if !ok {
+		t.Fatalf("Lookup after Register reported a miss")
+	}
+	if got.Name != "read" {
+		t.Fatalf("Lookup().Name = %q, want %q", got.Name, "read")
+	}
+
+	replacement := SyscallSpec{Name: "pread64"}
+	table.Register(0, replacement)
+	got, ok = table.Lookup(0)
+	if !ok || got.Name != "pread64" {
+		t.Fatalf("Lookup() after replacing Register = %+v, want Name %q", got, "pread64")
+	}
+}
+
+// TestDecodedSyscallFields verifies that decodedSyscallFields renders each
+// ArgType under the field name(s) documented on ArgSpec, including the
+// "_ptr" and "_str" synthetic fields for ArgPath and ArgFlags.
+func TestDecodedSyscallFields(t *testing.T) {
+	spec := SyscallSpec{
+		Name: "openat",
+		Args: [6]ArgSpec{
+			{Name: "dfd", Type: ArgFd},
+			{Name: "path", Type: ArgPath},
+			{Name: "flags", Type: ArgFlags, FlagBits: openFlagBits},
+			{Name: "mode", Type: ArgMode},
+		},
+	}
+	args := [6]uint64{3, 0xdeadbeef, 0x0040, 0644}
+
+	fields := decodedSyscallFields(spec, args)
+
+	if got, ok := fields["dfd"]; !ok || got.(uint64) != 3 {
+		t.Errorf("fields[%q] = %v, want %v", "dfd", got, uint64(3))
+	}
+	if got, ok := fields["path_ptr"]; !ok || got.(uint64) != 0xdeadbeef {
+		t.Errorf("fields[%q] = %v, want %v", "path_ptr", got, uint64(0xdeadbeef))
+	}
+	if _, ok := fields["path"]; ok {
+		t.Errorf("fields[%q] present, want ArgPath to only decode as path_ptr", "path")
+	}
+	if got, ok := fields["flags_str"]; !ok || got.(string) != "O_CREAT" {
+		t.Errorf("fields[%q] = %v, want %v", "flags_str", got, "O_CREAT")
+	}
+	if got, ok := fields["mode"]; !ok || got.(uint64) != 0644 {
+		t.Errorf("fields[%q] = %v, want %v", "mode", got, uint64(0644))
+	}
+}
+
+// TestSyscallEnterEventTypesForTable verifies that the synthetic decoded
+// fields of every syscall registered in a table are widened into the
+// returned FieldTypeMap, alongside (not replacing) the base
+// SyscallEnterEventTypes fields.
+func TestSyscallEnterEventTypesForTable(t *testing.T) {
+	table := NewSyscallTable()
+	table.Register(2, SyscallSpec{Name: "open", Args: [6]ArgSpec{
+		{Name: "path", Type: ArgPath},
+		{Name: "flags", Type: ArgFlags, FlagBits: openFlagBits},
+	}})
+
+	types := SyscallEnterEventTypesForTable(table)
+
+	for field, wantType := range SyscallEnterEventTypes {
+		if got, ok := types[field]; !ok || got != wantType {
+			t.Errorf("types[%q] = %v, ok %v, want %v", field, got, ok, wantType)
+		}
+	}
+
+	stringFields := []string{"flags_str"}
+	uint64Fields := []string{"path_ptr", "flags"}
+
+	for _, field := range append(append([]string{}, stringFields...), uint64Fields...) {
+		if _, ok := types[field]; !ok {
+			t.Errorf("types[%q] missing", field)
+		}
+	}
+	for _, field := range uint64Fields {
+		if types[field] != types["arg0"] {
+			t.Errorf("types[%q] = %v, want the same unsigned-int64 type as types[%q] (%v)", field, types[field], "arg0", types["arg0"])
+		}
+	}
+	if types["flags_str"] == types["arg0"] {
+		t.Errorf("types[%q] should not be the same type as a uint64 field", "flags_str")
+	}
+}
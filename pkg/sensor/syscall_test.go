@@ -0,0 +1,46 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sensor
+
+import "testing"
+
+// TestSyscallFieldValues verifies that syscallFieldValues maps a
+// SyscallTelemetryEvent's fields under the same names SyscallEventTypes
+// declares them under, since a filter is evaluated against this map, not the
+// struct directly.
+func TestSyscallFieldValues(t *testing.T) {
+	var e SyscallTelemetryEvent
+	e.ID = 59 // execve
+	e.ABI = ABI64
+	e.Arguments = [6]uint64{1, 2, 3, 4, 5, 6}
+	e.Return = -1
+
+	values := syscallFieldValues(e)
+	for field, want := range map[string]interface{}{
+		"id":   e.ID,
+		"abi":  uint8(e.ABI),
+		"arg0": e.Arguments[0],
+		"arg1": e.Arguments[1],
+		"arg2": e.Arguments[2],
+		"arg3": e.Arguments[3],
+		"arg4": e.Arguments[4],
+		"arg5": e.Arguments[5],
+		"ret":  e.Return,
+	} {
+		if got := values[field]; got != want {
+			t.Errorf("values[%q] = %v, want %v", field, got, want)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package telemetry implements the capsule8.telemetry.TelemetryService gRPC
+// service (see api/v0/telemetry/telemetry.proto), giving operators a
+// standard, filterable pub-sub interface onto sensor telemetry instead of
+// the in-process callback model that pkg/sensor.Subscription.Run exposes
+// directly.
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	pb "github.com/capsule8/capsule8/api/v0/telemetry"
+	"github.com/capsule8/capsule8/pkg/expression"
+	"github.com/capsule8/capsule8/pkg/sensor"
+
+	"github.com/golang/glog"
+	uuid "github.com/satori/go.uuid"
+)
+
+// pathRegistrars maps a SubscriptionRequest path to the Subscription
+// registration calls it selects. Paths not listed here are ignored; an
+// empty path list subscribes to every path in this table.
+var pathRegistrars = map[string]func(*sensor.Subscription, *expression.Expression){
+	"syscalls": func(sub *sensor.Subscription, expr *expression.Expression) {
+		sub.RegisterSyscallEventFilter(expr)
+	},
+	"network/connect": func(sub *sensor.Subscription, expr *expression.Expression) {
+		sub.RegisterNetworkConnectAttemptEventFilter(expr)
+		sub.RegisterNetworkConnectResultEventFilter(expr)
+	},
+	"network/accept": func(sub *sensor.Subscription, expr *expression.Expression) {
+		sub.RegisterNetworkAcceptAttemptEventFilter(expr)
+		sub.RegisterNetworkAcceptResultEventFilter(expr)
+	},
+	"network/bind": func(sub *sensor.Subscription, expr *expression.Expression) {
+		sub.RegisterNetworkBindAttemptEventFilter(expr)
+		sub.RegisterNetworkBindResultEventFilter(expr)
+	},
+	"network/listen": func(sub *sensor.Subscription, expr *expression.Expression) {
+		sub.RegisterNetworkListenAttemptEventFilter(expr)
+		sub.RegisterNetworkListenResultEventFilter(expr)
+	},
+	"network/recvfrom": func(sub *sensor.Subscription, expr *expression.Expression) {
+		sub.RegisterNetworkRecvfromAttemptEventFilter(expr)
+		sub.RegisterNetworkRecvfromResultEventFilter(expr)
+	},
+	"network/sendto": func(sub *sensor.Subscription, expr *expression.Expression) {
+		sub.RegisterNetworkSendtoAttemptEventFilter(expr)
+		sub.RegisterNetworkSendtoResultEventFilter(expr)
+	},
+}
+
+// registerPaths wires sub up to every registrar named in paths (or all of
+// them, if paths is empty), applying expr as the common filter.
+func registerPaths(sub *sensor.Subscription, expr *expression.Expression, paths []string) {
+	if len(paths) == 0 {
+		for _, register := range pathRegistrars {
+			register(sub, expr)
+		}
+		return
+	}
+	for _, path := range paths {
+		if register, ok := pathRegistrars[path]; ok {
+			register(sub, expr)
+		} else {
+			glog.Warningf("telemetry: unknown subscription path %q", path)
+		}
+	}
+}
+
+// Server implements pb.TelemetryServiceServer on top of a *sensor.Sensor.
+type Server struct {
+	sensor *sensor.Sensor
+
+	mu            sync.Mutex
+	subscriptions map[string]*activeSubscription
+
+	eventsDeliveredTotal int64
+	eventsDroppedTotal   int64
+}
+
+// activeSubscription tracks the state of a single TelemetrySubscribe call
+// for GetSubscriptions and CancelSubscription.
+type activeSubscription struct {
+	id         string
+	request    *pb.SubscriptionRequest
+	cancel     chan struct{}
+	cancelOnce sync.Once
+	done       chan struct{}
+	delivered  int64
+	dropped    int64
+}
+
+// NewServer creates a Server that serves telemetry from s.
+func NewServer(s *sensor.Sensor) *Server {
+	return &Server{
+		sensor:        s,
+		subscriptions: make(map[string]*activeSubscription),
+	}
+}
+
+// TelemetrySubscribe implements pb.TelemetryServiceServer. It wraps a
+// sensor.Subscription created from req's filter and multiplexes its
+// DispatchEvent output onto stream, applying backpressure by dropping
+// (and counting) events the client isn't keeping up with rather than
+// blocking the sensor's dispatch path.
+func (srv *Server) TelemetrySubscribe(req *pb.SubscriptionRequest, stream pb.TelemetryService_TelemetrySubscribeServer) error {
+	expr, err := expression.Parse(req.Filter)
+	if err != nil {
+		return fmt.Errorf("invalid filter: %v", err)
+	}
+
+	id := uuid.NewV4().String()
+	as := &activeSubscription{
+		id:      id,
+		request: req,
+		cancel:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	srv.addSubscription(as)
+	// removeSubscription must run before done is closed: once done is
+	// closed, a concurrent CancelSubscription(id) that is already
+	// blocked on <-as.done (below) is about to return success, so the
+	// subscription needs to already be gone from srv.subscriptions by
+	// then, not merely about to be removed.
+	defer close(as.done)
+	defer srv.removeSubscription(id)
+
+	sub := srv.sensor.NewSubscription()
+	registerPaths(sub, expr, req.Paths)
+
+	// events is deliberately small and non-blocking on the send side:
+	// a slow gRPC client should lose events, not stall the sensor's
+	// dispatch goroutine.
+	events := make(chan sensor.TelemetryEvent, 64)
+	errs, err := sub.Run(stream.Context(), func(event sensor.TelemetryEvent) {
+		select {
+		case events <- event:
+		default:
+			atomic.AddInt64(&as.dropped, 1)
+			atomic.AddInt64(&srv.eventsDroppedTotal, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	var seq int64
+	for {
+		select {
+		case event := <-events:
+			payload, err := json.Marshal(event)
+			if err != nil {
+				glog.Warningf("telemetry: could not marshal event: %v", err)
+				continue
+			}
+			seq++
+			msg := &pb.TelemetryEvent{
+				SubscriptionId: id,
+				EventType:      fmt.Sprintf("%T", event),
+				Payload:        payload,
+				SequenceNumber: seq,
+			}
+			if req.MaxMessageSize > 0 && int64(len(msg.Payload)) > req.MaxMessageSize {
+				atomic.AddInt64(&as.dropped, 1)
+				atomic.AddInt64(&srv.eventsDroppedTotal, 1)
+				continue
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+			atomic.AddInt64(&as.delivered, 1)
+			atomic.AddInt64(&srv.eventsDeliveredTotal, 1)
+		case subErrs := <-errsOrNil(errs):
+			if len(subErrs) > 0 {
+				return fmt.Errorf("subscription errors: %v", subErrs)
+			}
+		case <-as.cancel:
+			return nil
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// errsOrNil turns a nil channel into one that is never ready, so a range
+// over select doesn't spin when there is no error channel to watch.
+func errsOrNil(errs <-chan []error) <-chan []error {
+	if errs == nil {
+		return nil
+	}
+	return errs
+}
+
+// CancelSubscription implements pb.TelemetryServiceServer.
+func (srv *Server) CancelSubscription(ctx context.Context, req *pb.CancelSubscriptionRequest) (*pb.CancelSubscriptionResponse, error) {
+	srv.mu.Lock()
+	as, ok := srv.subscriptions[req.SubscriptionId]
+	srv.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", req.SubscriptionId)
+	}
+
+	as.cancelOnce.Do(func() { close(as.cancel) })
+	<-as.done
+	return &pb.CancelSubscriptionResponse{}, nil
+}
+
+// GetSubscriptions implements pb.TelemetryServiceServer.
+func (srv *Server) GetSubscriptions(ctx context.Context, req *pb.GetSubscriptionsRequest) (*pb.GetSubscriptionsResponse, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	resp := &pb.GetSubscriptionsResponse{
+		Subscriptions: make([]*pb.SubscriptionInfo, 0, len(srv.subscriptions)),
+	}
+	for _, as := range srv.subscriptions {
+		resp.Subscriptions = append(resp.Subscriptions, &pb.SubscriptionInfo{
+			SubscriptionId:  as.id,
+			Request:         as.request,
+			EventsDelivered: atomic.LoadInt64(&as.delivered),
+			EventsDropped:   atomic.LoadInt64(&as.dropped),
+		})
+	}
+	return resp, nil
+}
+
+// GetOperationalState implements pb.TelemetryServiceServer.
+func (srv *Server) GetOperationalState(ctx context.Context, req *pb.GetOperationalStateRequest) (*pb.GetOperationalStateResponse, error) {
+	srv.mu.Lock()
+	active := int64(len(srv.subscriptions))
+	srv.mu.Unlock()
+
+	return &pb.GetOperationalStateResponse{
+		ActiveSubscriptions:  active,
+		EventsDeliveredTotal: atomic.LoadInt64(&srv.eventsDeliveredTotal),
+		EventsDroppedTotal:   atomic.LoadInt64(&srv.eventsDroppedTotal),
+		SensorId:             srv.sensor.ID,
+	}, nil
+}
+
+func (srv *Server) addSubscription(as *activeSubscription) {
+	srv.mu.Lock()
+	srv.subscriptions[as.id] = as
+	srv.mu.Unlock()
+}
+
+func (srv *Server) removeSubscription(id string) {
+	srv.mu.Lock()
+	delete(srv.subscriptions, id)
+	srv.mu.Unlock()
+}
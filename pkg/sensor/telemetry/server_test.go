@@ -0,0 +1,110 @@
+// Copyright 2017 Capsule8, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package telemetry
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/capsule8/capsule8/api/v0/telemetry"
+)
+
+// newTestServer returns a Server with no sensor attached, suitable for
+// exercising the subscription bookkeeping (addSubscription, removeSubscription,
+// CancelSubscription) that doesn't touch srv.sensor.
+func newTestServer() *Server {
+	return &Server{subscriptions: make(map[string]*activeSubscription)}
+}
+
+func TestCancelSubscriptionIsIdempotent(t *testing.T) {
+	srv := newTestServer()
+	as := &activeSubscription{
+		id:     "sub-1",
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	srv.addSubscription(as)
+
+	// removeSubscription runs before done is closed, same as
+	// TelemetrySubscribe's deferred teardown order.
+	go func() {
+		<-as.cancel
+		srv.removeSubscription(as.id)
+		close(as.done)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := srv.CancelSubscription(context.Background(), &pb.CancelSubscriptionRequest{SubscriptionId: as.id}); err != nil {
+				t.Errorf("CancelSubscription: %v", err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("concurrent CancelSubscription calls did not all return; double-close guard likely broken")
+	}
+
+	select {
+	case <-as.cancel:
+	default:
+		t.Fatal("as.cancel was never closed")
+	}
+}
+
+func TestCancelSubscriptionUnknownID(t *testing.T) {
+	srv := newTestServer()
+	if _, err := srv.CancelSubscription(context.Background(), &pb.CancelSubscriptionRequest{SubscriptionId: "does-not-exist"}); err == nil {
+		t.Fatal("expected an error canceling an unknown subscription id, got nil")
+	}
+}
+
+func TestTeardownRemovesSubscription(t *testing.T) {
+	// Mirrors TelemetrySubscribe's deferred teardown order: removeSubscription
+	// must run before done is closed, so that a CancelSubscription blocked on
+	// <-as.done only returns once the subscription is actually gone from
+	// srv.subscriptions.
+	srv := newTestServer()
+	as := &activeSubscription{
+		id:     "sub-2",
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	srv.addSubscription(as)
+
+	as.cancelOnce.Do(func() { close(as.cancel) })
+	srv.removeSubscription(as.id)
+	close(as.done)
+
+	srv.mu.Lock()
+	_, stillPresent := srv.subscriptions[as.id]
+	srv.mu.Unlock()
+	if stillPresent {
+		t.Fatal("subscription still present in srv.subscriptions after teardown")
+	}
+}